@@ -0,0 +1,223 @@
+// Vigilant/proxy/accesslog.go
+// ACCESS LOG: one structured JSON record per request, passes included
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_LOG_STDOUT = "stdout"
+	ACCESS_LOG_STDERR = "stderr"
+)
+
+// AccessLogConfig writes a JSON line per request to Path: a file, or stdout
+// or stderr. Level drops records below it (debug, info, warn, error;
+// default info). Passes log at info, blocks and redactions at warn, failed
+// scans at error, and every daemon call at debug.
+type AccessLogConfig struct {
+	Path  string `json:"path"`
+	Level string `json:"level"`
+}
+
+func (a AccessLogConfig) level() slog.Level {
+	var l slog.Level
+	if l.UnmarshalText([]byte(a.Level)) != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func (a AccessLogConfig) validate() []ConfigProblem {
+	var l slog.Level
+	if a.Level != "" && l.UnmarshalText([]byte(a.Level)) != nil {
+		return []ConfigProblem{{Field: "access_log.level", Message: fmt.Sprintf("unknown level %q (want debug, info, warn or error)", a.Level)}}
+	}
+	return nil
+}
+
+// liveLevel reads the level from the live config, so a reload changes it.
+type liveLevel struct{}
+
+func (liveLevel) Level() slog.Level { return currentConfig().AccessLog.level() }
+
+var accessLog *slog.Logger
+
+// accessLogFile is set when the access log goes to a file.
+var accessLogFile *os.File
+
+func initAccessLog() {
+	cfg := currentConfig().AccessLog
+	var w io.Writer
+	switch cfg.Path {
+	case "":
+		return
+	case ACCESS_LOG_STDOUT:
+		w = os.Stdout
+	case ACCESS_LOG_STDERR:
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalf("ACCESS_LOG_OPEN_FAIL: %v", err)
+		}
+		w, accessLogFile = f, f
+	}
+	accessLog = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: liveLevel{}}))
+	log.Printf("[ACCESS_LOG] Writing request records to %s", cfg.Path)
+}
+
+// accessEntry collects what one request's record reports. A batch adds one
+// verdict per document; the record keeps the worst verdict and top score.
+type accessEntry struct {
+	mu       sync.Mutex
+	id       string
+	verdict  string
+	score    int
+	simulate bool
+	docs     int
+	findings map[string]int
+	daemons  map[string]time.Duration
+}
+
+type accessKey struct{}
+
+func accessFrom(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessKey{}).(*accessEntry)
+	return e
+}
+
+var verdictRank = map[string]int{VERDICT_PASS: 1, VERDICT_REDACT: 2, VERDICT_BLOCK: 3}
+
+// noteVerdict adds one scanned document's result to the request's record.
+func noteVerdict(ctx context.Context, res ScanResult) {
+	e := accessFrom(ctx)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.docs++
+	e.simulate = e.simulate || res.Simulated
+	if verdictRank[res.Verdict] > verdictRank[e.verdict] {
+		e.verdict = res.Verdict
+	}
+	e.score = max(e.score, res.Score)
+	for _, f := range res.Findings {
+		if e.findings == nil {
+			e.findings = make(map[string]int)
+		}
+		e.findings[f.Type]++
+	}
+}
+
+// noteDaemon adds one daemon call's latency to the request's record, and
+// logs the call itself at debug.
+func noteDaemon(ctx context.Context, sock string, start time.Time, err error) {
+	e := accessFrom(ctx)
+	if e == nil {
+		return
+	}
+	d := time.Since(start)
+	e.mu.Lock()
+	if e.daemons == nil {
+		e.daemons = make(map[string]time.Duration)
+	}
+	e.daemons[sock] += d
+	e.mu.Unlock()
+	if accessLog.Enabled(ctx, slog.LevelDebug) {
+		attrs := []slog.Attr{slog.String("request_id", e.id), slog.String("socket", sock), slog.Float64("ms", ms(d))}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		accessLog.LogAttrs(ctx, slog.LevelDebug, "daemon_call", attrs...)
+	}
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// withAccessLog writes the request's record once it completes. It runs
+// inside withRequestLog, whose X-Request-ID it reuses.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		e := &accessEntry{id: w.Header().Get("X-Request-ID")}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		r = r.WithContext(context.WithValue(r.Context(), accessKey{}, e))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case e.simulate:
+		case e.verdict == VERDICT_BLOCK || e.verdict == VERDICT_REDACT || rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", e.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", ms(time.Since(start))),
+			slog.Int64("bytes", body.n),
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			attrs = append(attrs, slog.Group("client",
+				slog.String("subject", cert.Subject.String()),
+				slog.String("fingerprint", certFingerprint(cert.Raw))))
+		}
+		if e.verdict != "" {
+			attrs = append(attrs, slog.String("verdict", e.verdict), slog.Int("score", e.score))
+			if e.simulate {
+				attrs = append(attrs, slog.Bool("simulated", true))
+			}
+			if e.docs > 1 {
+				attrs = append(attrs, slog.Int("documents", e.docs))
+			}
+		}
+		if len(e.findings) > 0 {
+			attrs = append(attrs, slog.Any("findings", e.findings))
+		}
+		if len(e.daemons) > 0 {
+			lat := make(map[string]float64, len(e.daemons))
+			for sock, d := range e.daemons {
+				lat[sock] = ms(d)
+			}
+			attrs = append(attrs, slog.Any("daemon_ms", lat))
+		}
+		accessLog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
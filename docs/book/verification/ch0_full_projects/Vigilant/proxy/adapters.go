@@ -0,0 +1,132 @@
+// Vigilant/proxy/adapters.go
+// SEND ADAPTERS: per-daemon wire format for the outbound payload
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Daemon names used to key per-daemon configuration.
+const (
+	DAEMON_SHIELD  = "shield"
+	DAEMON_ANALYST = "analyst"
+)
+
+const (
+	SEND_RAW           = "raw"
+	SEND_PREFIX        = "prefix"
+	SEND_JSON_ENVELOPE = "json_envelope"
+
+	ENVELOPE_TEXT   = "text"
+	ENVELOPE_BASE64 = "base64"
+
+	DEFAULT_ENVELOPE_FIELD = "data"
+)
+
+// errUnencodablePayload means the body cannot be expressed in a daemon's
+// wire format (e.g. binary data for a text envelope). It is the client's
+// payload at fault, not the daemon.
+var errUnencodablePayload = errors.New("PAYLOAD_UNENCODABLE")
+
+type DaemonConfig struct {
+	Name string      `json:"name"`
+	Send SendAdapter `json:"send"`
+
+	// A daemon other than shield and analyst is an extra scanner on its own
+	// Socket. Shadow daemons also get a copy of every scan on their Socket,
+	// but their findings are compared against the verdict, never part of it.
+	Shadow bool   `json:"shadow"`
+	Socket string `json:"socket"`
+
+	// Pool reuses connections to a daemon that speaks length-prefixed
+	// framing. Without it every scan dials a one-shot connection.
+	Pool *PoolConfig `json:"pool,omitempty"`
+}
+
+// SendAdapter transforms the request body before it is written to a daemon.
+// The zero value sends raw bytes, matching the historical behavior.
+//
+//	raw:           body as-is (Rust shield)
+//	prefix:        Prefix + body
+//	json_envelope: {"<Field>": "<body>"} with Encoding text or base64 (Python analyst)
+//
+// A json_envelope with TraceField set also carries the W3C traceparent of
+// the daemon's span under that key, so the daemon can continue the trace.
+type SendAdapter struct {
+	Format     string `json:"format"`
+	Prefix     string `json:"prefix,omitempty"`
+	Field      string `json:"field,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+	TraceField string `json:"trace_field,omitempty"`
+}
+
+func (a SendAdapter) Transform(body []byte, traceparent string) ([]byte, error) {
+	switch a.Format {
+	case "", SEND_RAW:
+		return body, nil
+	case SEND_PREFIX:
+		out := make([]byte, 0, len(a.Prefix)+len(body))
+		return append(append(out, a.Prefix...), body...), nil
+	case SEND_JSON_ENVELOPE:
+		field := a.Field
+		if field == "" {
+			field = DEFAULT_ENVELOPE_FIELD
+		}
+		var value string
+		switch a.Encoding {
+		case "", ENVELOPE_TEXT:
+			if !utf8.Valid(body) {
+				return nil, fmt.Errorf("%w: body is not valid UTF-8 for a text envelope", errUnencodablePayload)
+			}
+			value = string(body)
+		case ENVELOPE_BASE64:
+			value = base64.StdEncoding.EncodeToString(body)
+		}
+		envelope := map[string]string{field: value}
+		if a.TraceField != "" && traceparent != "" {
+			envelope[a.TraceField] = traceparent
+		}
+		return json.Marshal(envelope)
+	}
+	return nil, fmt.Errorf("SEND_FORMAT_UNKNOWN: %q", a.Format)
+}
+
+func (a SendAdapter) validate(field string) []ConfigProblem {
+	var problems []ConfigProblem
+	switch a.Format {
+	case "", SEND_RAW, SEND_PREFIX:
+		if a.TraceField != "" {
+			problems = append(problems, ConfigProblem{Field: field + ".trace_field", Message: "only supported with format \"json_envelope\""})
+		}
+		if a.Format == SEND_PREFIX && a.Prefix == "" {
+			problems = append(problems, ConfigProblem{Field: field + ".prefix", Message: "must not be empty for format \"prefix\""})
+		}
+	case SEND_JSON_ENVELOPE:
+		switch a.Encoding {
+		case "", ENVELOPE_TEXT, ENVELOPE_BASE64:
+		default:
+			problems = append(problems, ConfigProblem{Field: field + ".encoding", Message: fmt.Sprintf("unknown encoding %q (want text or base64)", a.Encoding)})
+		}
+		if a.TraceField != "" && (a.TraceField == a.Field || (a.Field == "" && a.TraceField == DEFAULT_ENVELOPE_FIELD)) {
+			problems = append(problems, ConfigProblem{Field: field + ".trace_field", Message: "must differ from the payload field"})
+		}
+	default:
+		problems = append(problems, ConfigProblem{Field: field + ".format", Message: fmt.Sprintf("unknown format %q (want raw, prefix or json_envelope)", a.Format)})
+	}
+	return problems
+}
+
+// sendAdapter returns the configured adapter for a daemon, or raw.
+func (c *Config) sendAdapter(name string) SendAdapter {
+	for _, d := range c.Daemons {
+		if d.Name == name {
+			return d.Send
+		}
+	}
+	return SendAdapter{}
+}
@@ -0,0 +1,95 @@
+// Vigilant/proxy/alpn.go
+// PROTOCOL NEGOTIATION: explicit ALPN offer and HTTP version fallback
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	ALPN_H2      = "h2"
+	ALPN_HTTP1   = "http/1.1"
+	DEFAULT_ALPN = ALPN_H2 + "," + ALPN_HTTP1
+	ALPN_ENV     = "VIGILANT_ALPN"
+)
+
+// parseALPN turns a comma-separated protocol list into the ALPN offer, in
+// server preference order.
+func parseALPN(spec string) ([]string, error) {
+	var protos []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p != ALPN_H2 && p != ALPN_HTTP1 {
+			return nil, fmt.Errorf("ALPN_INVALID: %q (want %s and/or %s)", p, ALPN_H2, ALPN_HTTP1)
+		}
+		if !seen[p] {
+			seen[p] = true
+			protos = append(protos, p)
+		}
+	}
+	if len(protos) == 0 {
+		return nil, fmt.Errorf("ALPN_INVALID: no protocols in %q", spec)
+	}
+	return protos, nil
+}
+
+// applyALPN configures server to speak exactly protos. Leaving h2 out serves
+// HTTP/1.1 only; leaving http/1.1 out refuses clients that don't negotiate h2,
+// including those that send no ALPN at all.
+func applyALPN(server *http.Server, protos []string) {
+	server.Protocols = new(http.Protocols)
+	for _, p := range protos {
+		switch p {
+		case ALPN_H2:
+			server.Protocols.SetHTTP2(true)
+		case ALPN_HTTP1:
+			server.Protocols.SetHTTP1(true)
+		}
+	}
+	server.TLSConfig.NextProtos = protos
+	if !server.Protocols.HTTP1() {
+		server.TLSConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.NegotiatedProtocol != ALPN_H2 {
+				return fmt.Errorf("ALPN_REQUIRED: client did not negotiate %s", ALPN_H2)
+			}
+			return nil
+		}
+	}
+	server.ConnState = logNegotiatedProtocol()
+}
+
+// logNegotiatedProtocol logs the ALPN result once per connection, when its
+// first request arrives (the handshake is complete by then).
+func logNegotiatedProtocol() func(net.Conn, http.ConnState) {
+	var logged sync.Map
+	return func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive:
+			tc, ok := c.(*tls.Conn)
+			if !ok {
+				return
+			}
+			if _, seen := logged.LoadOrStore(c, true); seen {
+				return
+			}
+			proto := tc.ConnectionState().NegotiatedProtocol
+			if proto == "" {
+				proto = "none (" + ALPN_HTTP1 + ")"
+			}
+			log.Printf("[ALPN] %s negotiated %s", c.RemoteAddr(), proto)
+		case http.StateClosed, http.StateHijacked:
+			logged.Delete(c)
+		}
+	}
+}
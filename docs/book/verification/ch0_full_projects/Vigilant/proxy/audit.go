@@ -0,0 +1,401 @@
+// Vigilant/proxy/audit.go
+// AUDIT TRAIL: one de-identified JSON record per scanned document
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Metadata that may be kept next to the body hash. None of it contains
+// request content.
+const (
+	AUDIT_META_LENGTH       = "length"
+	AUDIT_META_CONTENT_TYPE = "content_type"
+	AUDIT_META_FINDINGS     = "findings"
+
+	AUDIT_ENC_ALG  = "X25519-HKDF-SHA256-AES256GCM"
+	AUDIT_HKDF_TAG = "vigilant-audit-v1"
+)
+
+var defaultAuditMetadata = []string{AUDIT_META_LENGTH, AUDIT_META_CONTENT_TYPE, AUDIT_META_FINDINGS}
+
+// AuditConfig enables the audit trail. The raw body is never written: records
+// carry its SHA-256, the selected metadata and, only when EncryptBodyKey is
+// set, the body sealed to that X25519 public key.
+type AuditConfig struct {
+	Path           string   `json:"path"`
+	Metadata       []string `json:"metadata"`
+	EncryptBodyKey string   `json:"encrypt_body_key"`
+	recipient      *ecdh.PublicKey
+}
+
+func (a *AuditConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, m := range a.Metadata {
+		switch m {
+		case AUDIT_META_LENGTH, AUDIT_META_CONTENT_TYPE, AUDIT_META_FINDINGS:
+		default:
+			add(fmt.Sprintf("audit.metadata[%d]", i), "unknown field %q (want %s, %s or %s)", m, AUDIT_META_LENGTH, AUDIT_META_CONTENT_TYPE, AUDIT_META_FINDINGS)
+		}
+	}
+	a.recipient = nil
+	if a.EncryptBodyKey != "" {
+		key, err := parseX25519Public(a.EncryptBodyKey)
+		if err != nil {
+			add("audit.encrypt_body_key", "%v", err)
+		} else {
+			a.recipient = key
+		}
+	}
+	if a.Path == "" && (len(a.Metadata) > 0 || a.EncryptBodyKey != "") {
+		add("audit.path", "required when other audit settings are given")
+	}
+	return problems
+}
+
+func (a *AuditConfig) keeps(field string) bool {
+	meta := a.Metadata
+	if meta == nil {
+		meta = defaultAuditMetadata
+	}
+	for _, m := range meta {
+		if m == field {
+			return true
+		}
+	}
+	return false
+}
+
+// SealedBody is a request body encrypted for the holder of the audit key.
+type SealedBody struct {
+	Alg          string `json:"alg"`
+	EphemeralKey string `json:"epk"`
+	Nonce        string `json:"nonce"`
+	Ciphertext   string `json:"ct"`
+}
+
+// AuditRecord is one line of the audit trail.
+type AuditRecord struct {
+	Time        time.Time      `json:"time"`
+	RequestID   string         `json:"request_id"`
+	Path        string         `json:"path"`
+	Verdict     string         `json:"verdict"`
+	Score       int            `json:"score"`
+	BodySHA256  string         `json:"body_sha256"`
+	Length      *int           `json:"length,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Findings    map[string]int `json:"findings,omitempty"`
+	Rules       map[string]int `json:"rules,omitempty"`
+	Simulated   bool           `json:"simulated,omitempty"`
+	Body        *SealedBody    `json:"body,omitempty"`
+}
+
+// deidentify turns a scanned request into an audit record that holds no
+// request content unless it is sealed.
+func (a *AuditConfig) deidentify(r *http.Request, requestID, path string, body []byte, res ScanResult) (AuditRecord, error) {
+	rec := a.deidentifyDigest(r, requestID, path, sha256.Sum256(body), len(body), res)
+	if a.recipient != nil {
+		sealed, err := sealBody(a.recipient, body)
+		if err != nil {
+			return rec, err
+		}
+		rec.Body = sealed
+	}
+	return rec, nil
+}
+
+// deidentifyDigest builds the record from the body's digest and length
+// only. Nothing is sealed, since the body itself isn't available.
+func (a *AuditConfig) deidentifyDigest(r *http.Request, requestID, path string, sum [sha256.Size]byte, length int, res ScanResult) AuditRecord {
+	rec := AuditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  requestID,
+		Path:       path,
+		Verdict:    res.Verdict,
+		Score:      res.Score,
+		BodySHA256: hex.EncodeToString(sum[:]),
+		Simulated:  res.Simulated,
+	}
+	if a.keeps(AUDIT_META_LENGTH) {
+		rec.Length = &length
+	}
+	if a.keeps(AUDIT_META_CONTENT_TYPE) {
+		rec.ContentType = r.Header.Get("Content-Type")
+	}
+	if a.keeps(AUDIT_META_FINDINGS) && len(res.Findings) > 0 {
+		rec.Findings = make(map[string]int)
+		for _, f := range res.Findings {
+			rec.Findings[f.Type]++
+			// Messages may quote the content, so only rule IDs are kept.
+			if f.RuleID != "" {
+				if rec.Rules == nil {
+					rec.Rules = make(map[string]int)
+				}
+				rec.Rules[f.RuleID]++
+			}
+		}
+	}
+	return rec
+}
+
+// auditKey derives the AES-256 key from an X25519 shared secret, binding it
+// to both public keys.
+func auditKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral.Bytes()...), recipient.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, AUDIT_HKDF_TAG, 32)
+}
+
+// sealBody encrypts body with a fresh ephemeral X25519 key per record.
+func sealBody(recipient *ecdh.PublicKey, body []byte) (*SealedBody, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	key, err := auditKey(shared, eph.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &SealedBody{
+		Alg:          AUDIT_ENC_ALG,
+		EphemeralKey: base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()),
+		Nonce:        base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:   base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, body, nil)),
+	}, nil
+}
+
+func openBody(priv *ecdh.PrivateKey, s *SealedBody) ([]byte, error) {
+	if s.Alg != AUDIT_ENC_ALG {
+		return nil, fmt.Errorf("unsupported alg %q", s.Alg)
+	}
+	epkRaw, err := base64.StdEncoding.DecodeString(s.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	epk, err := ecdh.X25519().NewPublicKey(epkRaw)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(s.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(s.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(epk)
+	if err != nil {
+		return nil, err
+	}
+	key, err := auditKey(shared, epk, priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("bad nonce length")
+	}
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+// parseX25519Public accepts a PEM public key (openssl genpkey -algorithm
+// x25519) or the raw 32 bytes as hex or base64.
+func parseX25519Public(text string) (*ecdh.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(text)); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := pub.(*ecdh.PublicKey); ok && k.Curve() == ecdh.X25519() {
+			return k, nil
+		}
+		return nil, errors.New("PEM key is not an X25519 public key")
+	}
+	raw, err := decodeKeyText(text)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func parseX25519Private(data []byte) (*ecdh.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := priv.(*ecdh.PrivateKey); ok && k.Curve() == ecdh.X25519() {
+			return k, nil
+		}
+		return nil, errors.New("PEM key is not an X25519 private key")
+	}
+	raw, err := decodeKeyText(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+type auditWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var auditLog *auditWriter
+
+func openAuditLog(path string) (*auditWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditWriter{f: f}, nil
+}
+
+func (a *auditWriter) Write(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(append(line, '\n'))
+	return err
+}
+
+// auditScan writes the de-identified record for one verdict. Failures are
+// logged, never surfaced to the client.
+func auditScan(r *http.Request, requestID, path string, body []byte, res ScanResult) {
+	if auditLog == nil {
+		return
+	}
+	rec, err := currentConfig().Audit.deidentify(r, requestID, path, body, res)
+	if err == nil {
+		err = auditLog.Write(rec)
+	}
+	if err != nil {
+		log.Printf("[AUDIT_FAIL] id=%s: %v", requestID, err)
+	}
+}
+
+// auditStreamed is auditScan for a streamed body, known only by its digest
+// and length. Its record never carries a sealed body.
+func auditStreamed(r *http.Request, requestID, path string, sum [sha256.Size]byte, length int, res ScanResult) {
+	if auditLog == nil {
+		return
+	}
+	rec := currentConfig().Audit.deidentifyDigest(r, requestID, path, sum, length, res)
+	if err := auditLog.Write(rec); err != nil {
+		log.Printf("[AUDIT_FAIL] id=%s: %v", requestID, err)
+	}
+}
+
+func initAudit() {
+	cfg := currentConfig()
+	if cfg.Audit.Path == "" {
+		return
+	}
+	var err error
+	if auditLog, err = openAuditLog(cfg.Audit.Path); err != nil {
+		log.Fatalf("AUDIT_OPEN_FAIL: %v", err)
+	}
+	sealed := "bodies not kept"
+	if cfg.Audit.recipient != nil {
+		sealed = "bodies sealed to " + AUDIT_ENC_ALG
+	}
+	log.Printf("[AUDIT] Writing de-identified records to %s (%s)", cfg.Audit.Path, sealed)
+}
+
+// runAuditDecrypt reads audit records on stdin and prints each sealed body,
+// for forensics by the holder of the private key.
+func runAuditDecrypt(args []string) int {
+	fs := flag.NewFlagSet("audit-decrypt", flag.ContinueOnError)
+	keyPath := fs.String("key", "", "X25519 private key: PKCS#8 PEM, or a hex/base64 32-byte key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s audit-decrypt -key audit_key.pem < audit.jsonl\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" {
+		fs.Usage()
+		return 2
+	}
+	data, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "AUDIT_KEY_FAIL: %v\n", err)
+		return 2
+	}
+	priv, err := parseX25519Private(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "AUDIT_KEY_FAIL: %v\n", err)
+		return 2
+	}
+
+	failed := false
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || rec.Body == nil {
+			continue
+		}
+		body, err := openBody(priv, rec.Body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rec.RequestID, err)
+			failed = true
+			continue
+		}
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"request_id": rec.RequestID, "path": rec.Path, "body": string(body)})
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+// Vigilant/proxy/audit_test.go
+// AUDIT BODY SEALING: only the recipient's key opens an untouched body
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func sealTestBody(t *testing.T, body []byte) (*ecdh.PrivateKey, *SealedBody) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealBody(priv.PublicKey(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, sealed
+}
+
+func TestSealBodyRoundTrip(t *testing.T) {
+	body := []byte(`{"ssn": "078-05-1120"}`)
+	priv, sealed := sealTestBody(t, body)
+	if bytes.Contains([]byte(sealed.Ciphertext), body) {
+		t.Fatal("ciphertext contains the body")
+	}
+	got, err := openBody(priv, sealed)
+	if err != nil {
+		t.Fatalf("openBody: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("openBody = %q, want %q", got, body)
+	}
+
+	// Each record gets its own ephemeral key and nonce.
+	_, again := sealTestBody(t, body)
+	if again.EphemeralKey == sealed.EphemeralKey || again.Ciphertext == sealed.Ciphertext {
+		t.Fatal("two seals of the same body share a key or ciphertext")
+	}
+}
+
+func TestOpenBodyRejectsTamperedCiphertext(t *testing.T) {
+	priv, sealed := sealTestBody(t, []byte("secret document"))
+	ct, _ := base64.StdEncoding.DecodeString(sealed.Ciphertext)
+	ct[0] ^= 0x01
+	sealed.Ciphertext = base64.StdEncoding.EncodeToString(ct)
+	if got, err := openBody(priv, sealed); err == nil {
+		t.Fatalf("opened a tampered ciphertext: %q", got)
+	}
+}
+
+func TestOpenBodyRejectsWrongKey(t *testing.T) {
+	_, sealed := sealTestBody(t, []byte("secret document"))
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if got, err := openBody(other, sealed); err == nil {
+		t.Fatalf("opened with the wrong private key: %q", got)
+	}
+}
@@ -0,0 +1,145 @@
+// Vigilant/proxy/batch.go
+// BATCH SCANNING: many small documents, one request
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	DEFAULT_BATCH_MAX_ITEMS   = 256
+	DEFAULT_BATCH_CONCURRENCY = 8
+)
+
+type BatchConfig struct {
+	MaxItems    int `json:"max_items"`
+	Concurrency int `json:"concurrency"`
+}
+
+func (b BatchConfig) limits() (maxItems, concurrency int) {
+	maxItems, concurrency = b.MaxItems, b.Concurrency
+	if maxItems <= 0 {
+		maxItems = DEFAULT_BATCH_MAX_ITEMS
+	}
+	if concurrency <= 0 {
+		concurrency = DEFAULT_BATCH_CONCURRENCY
+	}
+	return maxItems, concurrency
+}
+
+// BatchItemResult is the per-document entry of a batch response. Exactly one
+// of Verdict or Error is set.
+type BatchItemResult struct {
+	Index   int    `json:"index"`
+	Verdict string `json:"verdict,omitempty"`
+	Score   int    `json:"score"`
+	Error   string `json:"error,omitempty"`
+
+	// Redacted is the masked document when Verdict is SECURE_REDACT.
+	Redacted string `json:"redacted,omitempty"`
+
+	// Simulated marks Verdict as the would-be verdict, not enforced: a
+	// simulated redaction carries no masked document.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+// batchDocument returns the bytes to scan for one batch element: JSON strings
+// are scanned as their decoded text, any other JSON value as-is.
+func batchDocument(raw json.RawMessage) []byte {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []byte(s)
+	}
+	return raw
+}
+
+// batchHandler accepts a JSON array of documents and answers with an array of
+// per-document verdicts in the same order. A failing item never fails the batch.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	body, ok := readBody(w, r, cfg)
+	if !ok {
+		return
+	}
+	r = confirmOverride(r, sha256.Sum256(body))
+	if err := cfg.checkJSONDepth(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(body, &docs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Batch body must be a JSON array\"}"))
+		return
+	}
+
+	maxItems, concurrency := cfg.Batch.limits()
+	if len(docs) > maxItems {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "{\"error\": \"Batch exceeds %d documents\"}", maxItems)
+		return
+	}
+
+	// One timeout covers the whole batch; documents still waiting for a
+	// daemon when it fires report the timeout as their error.
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.requestTimeout())
+	defer cancel()
+	id := w.Header().Get("X-Request-ID")
+	simulated := simulating(r, cfg)
+	results := make([]BatchItemResult, len(docs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, raw := range docs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, doc []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = BatchItemResult{Index: i}
+			res, err := scanDocument(ctx, doc)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			res.Simulated = simulated
+			results[i].Verdict = res.Verdict
+			results[i].Score = res.Score
+			results[i].Simulated = simulated
+			if !simulated {
+				results[i].Redacted = string(res.Redacted)
+			}
+			path := fmt.Sprintf("%s[%d]", r.URL.Path, i)
+			recentVerdicts.Add(id, path, res)
+			auditScan(r, id, path, doc, res)
+			metrics.countVerdict("/batch", res)
+			noteVerdict(ctx, res)
+		}(i, batchDocument(raw))
+	}
+	wg.Wait()
+
+	blocked := 0
+	for _, res := range results {
+		if res.Verdict == VERDICT_BLOCK {
+			blocked++
+		}
+	}
+	switch {
+	case simulated:
+		log.Printf("[SIMULATE] id=%s %s: %d/%d documents would be blocked; not enforced", id, r.URL.Path, blocked, len(results))
+		w.Header().Set(SIMULATED_HEADER, "true")
+	case blocked > 0:
+		log.Printf("[SECURITY_BLOCK] Batch: %d/%d documents blocked", blocked, len(results))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,40 @@
+// Vigilant/proxy/bodylimit.go
+// BODY LIMIT: cap request bodies before they are buffered or scanned
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+const DEFAULT_MAX_BODY_BYTES = 10 << 20
+
+func (c *Config) maxBodyBytes() int64 {
+	if c.MaxBodyBytes <= 0 {
+		return DEFAULT_MAX_BODY_BYTES
+	}
+	return c.MaxBodyBytes
+}
+
+// readBody reads the whole request body up to max_body_bytes. On failure the
+// response is written (413 when the body is too large) and ok is false.
+func readBody(w http.ResponseWriter, r *http.Request, cfg *Config) (body []byte, ok bool) {
+	limit := cfg.maxBodyBytes()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		log.Printf("[BODY_TOO_LARGE] %s exceeds %d bytes", r.URL.Path, limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "{\"error\": \"Body exceeds %d bytes\"}", limit)
+		return nil, false
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
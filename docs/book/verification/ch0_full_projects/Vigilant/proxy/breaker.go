@@ -0,0 +1,198 @@
+// Vigilant/proxy/breaker.go
+// CIRCUIT BREAKER: fail fast on a daemon that keeps failing
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+
+	ON_OPEN_FAIL_CLOSED = "fail_closed"
+	ON_OPEN_FAIL_OPEN   = "fail_open"
+
+	DEFAULT_BREAKER_COOLDOWN = 10 * time.Second
+)
+
+var errCircuitOpen = errors.New("CIRCUIT_OPEN")
+
+// BreakerConfig opens a daemon's circuit after Failures consecutive failed
+// calls (0 disables the breaker). For CooldownMs no call reaches it; then a
+// single probe is let through, and its outcome closes or reopens the circuit.
+//
+// OnOpen decides what a scan does while a daemon's circuit is open:
+//
+//	fail_closed: the document is blocked, unless quorum is met without it (default)
+//	fail_open:   the scan goes on with the other daemons only
+type BreakerConfig struct {
+	Failures   int    `json:"failures"`
+	CooldownMs int    `json:"cooldown_ms"`
+	OnOpen     string `json:"on_open"`
+}
+
+func (b BreakerConfig) cooldown() time.Duration {
+	if b.CooldownMs <= 0 {
+		return DEFAULT_BREAKER_COOLDOWN
+	}
+	return time.Duration(b.CooldownMs) * time.Millisecond
+}
+
+func (b BreakerConfig) failOpen() bool {
+	return b.OnOpen == ON_OPEN_FAIL_OPEN
+}
+
+func (b BreakerConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	if b.Failures < 0 {
+		problems = append(problems, ConfigProblem{Field: "circuit_breaker.failures", Message: fmt.Sprintf("must be >= 0, got %d", b.Failures)})
+	}
+	if b.CooldownMs < 0 {
+		problems = append(problems, ConfigProblem{Field: "circuit_breaker.cooldown_ms", Message: fmt.Sprintf("must be >= 0, got %d", b.CooldownMs)})
+	}
+	switch b.OnOpen {
+	case "", ON_OPEN_FAIL_CLOSED, ON_OPEN_FAIL_OPEN:
+	default:
+		problems = append(problems, ConfigProblem{Field: "circuit_breaker.on_open", Message: fmt.Sprintf("unknown mode %q (want %s or %s)", b.OnOpen, ON_OPEN_FAIL_CLOSED, ON_OPEN_FAIL_OPEN)})
+	}
+	return problems
+}
+
+// BreakerStats is one daemon socket's circuit as reported by /healthz.
+type BreakerStats struct {
+	Socket   string     `json:"socket"`
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	Trips    int64      `json:"trips"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	stats    BreakerStats
+	openedAt time.Time
+	probing  bool
+}
+
+type breakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var breakers = &breakerRegistry{breakers: make(map[string]*circuitBreaker)}
+
+func (r *breakerRegistry) get(sock string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[sock]
+	if !ok {
+		b = &circuitBreaker{stats: BreakerStats{Socket: sock, State: BREAKER_CLOSED}}
+		r.breakers[sock] = b
+	}
+	return b
+}
+
+func (r *breakerRegistry) Snapshot() []BreakerStats {
+	r.mu.Lock()
+	all := make([]*circuitBreaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		all = append(all, b)
+	}
+	r.mu.Unlock()
+
+	out := make([]BreakerStats, 0, len(all))
+	for _, b := range all {
+		b.mu.Lock()
+		s := b.stats
+		if s.State != BREAKER_CLOSED {
+			t := b.openedAt
+			s.OpenedAt = &t
+		}
+		b.mu.Unlock()
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Socket < out[j].Socket })
+	return out
+}
+
+// allow reports whether a call may go through. After the cooldown exactly
+// one caller gets through as the half-open probe.
+func (b *circuitBreaker) allow(cfg BreakerConfig) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stats.State {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < cfg.cooldown() {
+			return false
+		}
+		b.stats.State = BREAKER_HALF_OPEN
+		b.probing = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(cfg BreakerConfig, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sock := b.stats.Socket
+	if err == nil {
+		if b.stats.State != BREAKER_CLOSED {
+			log.Printf("[BREAKER_CLOSED] %s answered, closing circuit", sock)
+		}
+		b.stats.State, b.stats.Failures, b.probing = BREAKER_CLOSED, 0, false
+		return
+	}
+	b.stats.Failures++
+	if b.stats.State == BREAKER_HALF_OPEN || b.stats.Failures >= cfg.Failures {
+		if b.stats.State != BREAKER_OPEN {
+			b.stats.Trips++
+			log.Printf("[BREAKER_OPEN] %s after %d consecutive failures, cooling down %s: %v", sock, b.stats.Failures, cfg.cooldown(), err)
+		}
+		b.stats.State, b.openedAt, b.probing = BREAKER_OPEN, time.Now(), false
+	}
+}
+
+// abandon hands back a half-open probe whose call never got an answer for
+// reasons that aren't the daemon's, so the next caller can probe instead.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// guardedCall is callDaemon behind the socket's circuit breaker. With the
+// breaker disabled it is callDaemon. Retries happen inside the breaker, so
+// a call that needed three attempts counts as one failure or success.
+func guardedCall(ctx context.Context, cfg *Config, sock string, pool *PoolConfig, data []byte) ([]Finding, error) {
+	if cfg.Breaker.Failures == 0 {
+		return callDaemon(ctx, cfg.Retry, sock, pool, data)
+	}
+	b := breakers.get(sock)
+	if !b.allow(cfg.Breaker) {
+		return nil, errCircuitOpen
+	}
+	findings, err := callDaemon(ctx, cfg.Retry, sock, pool, data)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The client went away; that says nothing about the daemon.
+		b.abandon()
+		return findings, err
+	}
+	b.record(cfg.Breaker, err)
+	return findings, err
+}
@@ -0,0 +1,195 @@
+// Vigilant/proxy/bundle.go
+// `naab-vigilant support-bundle`: one tar.gz with everything a bug report needs
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+type bundleEntry struct {
+	name string
+	data []byte
+}
+
+// runSupportBundle collects the effective config, live gateway state,
+// daemon health and integrity digests. Secrets are redacted: no secret
+// file, private key, auth key or payload is copied into the bundle.
+func runSupportBundle(args []string) int {
+	fs := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	out := fs.String("o", fmt.Sprintf("vigilant-support-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")), "output file")
+	gateway := fs.String("gateway", DEFAULT_GATEWAY_URL, "running gateway to query for live state (empty to skip)")
+	fs.StringVar(&policySource, "policy", paths.Policy, "risk matrix file or policy directory (env "+POLICY_DIR_ENV+" or "+POLICY_FILE_ENV+")")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "usage: %s support-bundle [-o file.tar.gz] [-gateway url] [-policy path]\n", os.Args[0])
+		return 2
+	}
+	initSecrets()
+
+	var entries []bundleEntry
+	add := func(name string, v any) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			data = []byte(fmt.Sprintf("{\"error\": %q}\n", err.Error()))
+		}
+		entries = append(entries, bundleEntry{name, append(data, '\n')})
+	}
+
+	add("version.json", map[string]string{
+		"gateway":   GATEWAY_VERSION,
+		"go":        runtime.Version(),
+		"os_arch":   runtime.GOOS + "/" + runtime.GOARCH,
+		"collected": time.Now().UTC().Format(time.RFC3339),
+	})
+
+	cfg, problems, err := readConfig(policySource)
+	local := map[string]any{"source": policySource, "problems": problems}
+	if err != nil {
+		local["error"] = err.Error()
+	} else {
+		local["config"] = redactConfig(cfg)
+	}
+	add("config.json", local)
+
+	add("daemons.json", probeDaemons())
+	add("integrity.json", bundleIntegrity())
+	add("env.json", bundleEnv())
+
+	if *gateway != "" {
+		state, err := fetchGatewayState(*gateway)
+		if err != nil {
+			add("gateway_state.json", map[string]string{"error": err.Error()})
+		} else {
+			entries = append(entries, bundleEntry{"gateway_state.json", state})
+		}
+	}
+
+	if err := writeBundle(*out, entries); err != nil {
+		fmt.Fprintf(os.Stderr, "BUNDLE_WRITE_FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Support bundle written to %s (%d files)\n", *out, len(entries))
+	return 0
+}
+
+// bundleIntegrity digests the binary, policy files and PKI. Only SHA-256
+// digests are recorded, never file contents.
+func bundleIntegrity() map[string]string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	files := append([]string{exe, paths.CACert, paths.ServerCert, paths.ServerKey}, policyFiles(policySource)...)
+	digests := make(map[string]string)
+	for _, p := range files {
+		sum, err := verifyIntegrity(p)
+		if err != nil {
+			digests[p] = "unavailable: " + err.Error()
+			continue
+		}
+		digests[p] = sum
+	}
+	return digests
+}
+
+// bundleEnv records VIGILANT_* settings, redacting anything secret-looking.
+func bundleEnv() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, "VIGILANT_") {
+			continue
+		}
+		if secretField.MatchString(k) {
+			v = REDACTED
+		}
+		env[k] = v
+	}
+	return env
+}
+
+func fetchGatewayState(base string) ([]byte, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newMTLSClient(u.Hostname(), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	key, err := authKey()
+	if err != nil {
+		return nil, err
+	}
+	req, err := newGatewayRequest("GET", strings.TrimRight(base, "/")+"/debug/state", nil, key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("gateway answered %s", resp.Status)
+	}
+	return data, nil
+}
+
+func writeBundle(path string, entries []bundleEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	var manifest bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&manifest, "%s\t%d bytes\n", e.name, len(e.data))
+	}
+	entries = append([]bundleEntry{{"MANIFEST.txt", manifest.Bytes()}}, entries...)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	prefix := strings.TrimSuffix(filepath.Base(path), ".tar.gz") + "/"
+	now := time.Now()
+	for _, e := range entries {
+		hdr := &tar.Header{Name: prefix + e.name, Mode: 0o600, Size: int64(len(e.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,160 @@
+// Vigilant/proxy/cache.go
+// RESULT CACHE: bounded LRU of scan results for repeated payloads
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CACHE_TTL = 60 * time.Second
+
+// CacheConfig keeps the scorer chain's result for up to MaxEntries distinct
+// payloads (0 disables the cache), each for TTLMs. A hit skips every daemon
+// call, shadows included. Results are tied to the config they were scored
+// under, so a reload empties the cache.
+type CacheConfig struct {
+	MaxEntries int `json:"max_entries"`
+	TTLMs      int `json:"ttl_ms"`
+}
+
+func (c CacheConfig) ttl() time.Duration {
+	if c.TTLMs <= 0 {
+		return DEFAULT_CACHE_TTL
+	}
+	return time.Duration(c.TTLMs) * time.Millisecond
+}
+
+func (c CacheConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	if c.MaxEntries < 0 {
+		problems = append(problems, ConfigProblem{Field: "cache.max_entries", Message: fmt.Sprintf("must be >= 0, got %d", c.MaxEntries)})
+	}
+	if c.TTLMs < 0 {
+		problems = append(problems, ConfigProblem{Field: "cache.ttl_ms", Message: fmt.Sprintf("must be >= 0, got %d", c.TTLMs)})
+	}
+	return problems
+}
+
+// cacheKey is the policy set plus the digest of the scanned content; the
+// same payload scores differently under a signed override.
+type cacheKey struct {
+	rules  string
+	digest [sha256.Size]byte
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	res     ScanResult
+	expires time.Time
+}
+
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+type resultCache struct {
+	mu    sync.Mutex
+	cfg   *Config
+	order *list.List // front = most recently used
+	items map[cacheKey]*list.Element
+	stats CacheStats
+}
+
+var scanCache = &resultCache{order: list.New(), items: make(map[cacheKey]*list.Element)}
+
+// reset drops every entry and ties the cache to cfg. Called on reload.
+func (c *resultCache) reset(cfg *Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear(cfg)
+}
+
+func (c *resultCache) clear(cfg *Config) {
+	c.cfg = cfg
+	c.order.Init()
+	clear(c.items)
+	c.stats.Entries = 0
+}
+
+// current reports whether cfg is the config the entries belong to, starting
+// over if cfg is the live one. A request still running on a config that has
+// since been replaced neither reads nor stores. Callers hold c.mu.
+func (c *resultCache) current(cfg *Config) bool {
+	if c.cfg == cfg {
+		return true
+	}
+	if cfg != currentConfig() {
+		return false
+	}
+	c.clear(cfg)
+	return true
+}
+
+func (c *resultCache) get(cfg *Config, key cacheKey) (ScanResult, bool) {
+	if cfg.Cache.MaxEntries == 0 {
+		return ScanResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.current(cfg) {
+		return ScanResult{}, false
+	}
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return ScanResult{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		c.stats.Entries--
+		c.stats.Misses++
+		return ScanResult{}, false
+	}
+	c.order.MoveToFront(el)
+	c.stats.Hits++
+	res := e.res
+	res.Findings = slices.Clone(e.res.Findings)
+	return res, true
+}
+
+func (c *resultCache) put(cfg *Config, key cacheKey, res ScanResult) {
+	if cfg.Cache.MaxEntries == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.current(cfg) {
+		return
+	}
+	res.Findings = slices.Clone(res.Findings)
+	entry := &cacheEntry{key: key, res: res, expires: time.Now().Add(cfg.Cache.ttl())}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	c.stats.Entries++
+	for c.order.Len() > cfg.Cache.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		c.stats.Entries--
+	}
+}
+
+func (c *resultCache) Snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
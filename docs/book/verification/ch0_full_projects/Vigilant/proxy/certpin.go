@@ -0,0 +1,81 @@
+// Vigilant/proxy/certpin.go
+// CERT PINNING: only listed client certificates pass, on top of the CA check
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var errCertNotPinned = errors.New("CERT_NOT_PINNED")
+
+// certFingerprint is the SHA-256 of a certificate's DER bytes in lowercase
+// hex, as printed by `openssl x509 -noout -fingerprint -sha256` without the
+// colons.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// compilePinnedCerts validates pinned_client_certs. Entries may use upper
+// case and colons, as openssl prints them. Called from validateSettings.
+func (c *Config) compilePinnedCerts() []ConfigProblem {
+	var problems []ConfigProblem
+	c.pinnedCerts = nil
+	if len(c.PinnedClientCerts) == 0 {
+		return nil
+	}
+	c.pinnedCerts = make(map[string]bool, len(c.PinnedClientCerts))
+	for i, fp := range c.PinnedClientCerts {
+		norm := strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+		if b, err := hex.DecodeString(norm); err != nil || len(b) != sha256.Size {
+			problems = append(problems, ConfigProblem{Field: fmt.Sprintf("pinned_client_certs[%d]", i), Message: fmt.Sprintf("%q is not a SHA-256 fingerprint (64 hex digits)", fp)})
+			continue
+		}
+		c.pinnedCerts[norm] = true
+	}
+	return problems
+}
+
+// pinned reports whether the leaf certificate der may connect. With no
+// allowlist configured every CA-signed certificate may.
+func (c *Config) pinned(der []byte) bool {
+	return c.pinnedCerts == nil || c.pinnedCerts[certFingerprint(der)]
+}
+
+// verifyPinnedPeer is the tls.Config VerifyPeerCertificate hook. It runs
+// after the CA check and reads the live config, so a reload that drops a
+// fingerprint refuses that client's next handshake.
+func verifyPinnedPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errCertNotPinned
+	}
+	if !currentConfig().pinned(rawCerts[0]) {
+		log.Printf("[CERT_PIN_REJECT] handshake from %s", certFingerprint(rawCerts[0]))
+		return errCertNotPinned
+	}
+	return nil
+}
+
+// withCertPin repeats the pin check per request. Connections are kept alive,
+// so without it a revoked client could keep using a connection it opened
+// before the reload.
+func withCertPin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			if der := r.TLS.PeerCertificates[0].Raw; !currentConfig().pinned(der) {
+				log.Printf("[CERT_PIN_REJECT] request from %s on an open connection", certFingerprint(der))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
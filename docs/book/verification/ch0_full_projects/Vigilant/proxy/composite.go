@@ -0,0 +1,103 @@
+// Vigilant/proxy/composite.go
+// COMPOSITE POLICIES: score combinations of finding types, count each finding once
+
+package main
+
+import "fmt"
+
+// composite reports whether p scores a combination of types rather than
+// each finding of one type.
+func (p Policy) composite() bool {
+	return len(p.AllOf) > 0 || len(p.AnyOf) > 0
+}
+
+func (p Policy) validateComposite(field string) []ConfigProblem {
+	var problems []ConfigProblem
+	if p.Type != "" {
+		problems = append(problems, ConfigProblem{Field: field + ".type", Message: "must be empty when all_of or any_of is set"})
+	}
+	if len(p.AllOf) > 0 && len(p.AnyOf) > 0 {
+		problems = append(problems, ConfigProblem{Field: field, Message: "set all_of or any_of, not both"})
+	}
+	check := func(name string, types []string) {
+		for j, t := range types {
+			if t == "" {
+				problems = append(problems, ConfigProblem{Field: fmt.Sprintf("%s.%s[%d]", field, name, j), Message: "must not be empty"})
+			}
+		}
+	}
+	check("all_of", p.AllOf)
+	check("any_of", p.AnyOf)
+	return problems
+}
+
+// matches reports whether a composite policy's condition holds for the
+// types present.
+func (p Policy) matches(types map[string]bool) bool {
+	if len(p.AllOf) > 0 {
+		for _, t := range p.AllOf {
+			if !types[t] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, t := range p.AnyOf {
+		if types[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// compositeScore adds every composite policy whose condition holds, once
+// each, however many findings satisfy it.
+func (c *Config) compositeScore(findings []Finding) int {
+	total := 0
+	var types map[string]bool
+	for _, p := range c.Policies {
+		if !p.composite() {
+			continue
+		}
+		if types == nil {
+			types = findingTypes(findings)
+		}
+		if p.matches(types) {
+			total += p.Score
+		}
+	}
+	return total
+}
+
+// dedupeFindings keeps one finding per type and offset, so a span both
+// daemons report is scored once. The survivor is the most confident report,
+// widened to the longest reported span so redaction still masks all of it.
+// Span-less findings (Length 0) are all kept: without a location, two of
+// them may well be two different occurrences.
+func dedupeFindings(findings []Finding) []Finding {
+	type key struct {
+		typ    string
+		offset int
+	}
+	seen := make(map[key]int, len(findings))
+	out := make([]Finding, 0, len(findings))
+	for _, f := range findings {
+		if f.Length == 0 {
+			out = append(out, f)
+			continue
+		}
+		k := key{f.Type, f.Offset}
+		i, dup := seen[k]
+		if !dup {
+			seen[k] = len(out)
+			out = append(out, f)
+			continue
+		}
+		length := max(out[i].Length, f.Length)
+		if f.confidence() > out[i].confidence() {
+			out[i] = f
+		}
+		out[i].Length = length
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+// Vigilant/proxy/composite_test.go
+// FINDING DEDUPE: located spans merge, unlocated findings are all kept
+
+package main
+
+import "testing"
+
+func TestDedupeKeepsSpanlessFindings(t *testing.T) {
+	findings := []Finding{{Type: "ID_EMAIL"}, {Type: "ID_EMAIL"}}
+	if got := dedupeFindings(findings); len(got) != 2 {
+		t.Fatalf("dedupeFindings kept %d of 2 span-less findings, want both", len(got))
+	}
+
+	cfg := &Config{Policies: []Policy{{Type: "ID_EMAIL", Score: 20}}, DedupeFindings: true}
+	if got := cfg.baseRules().score(dedupeFindings(findings)); got != 40 {
+		t.Fatalf("score = %d, want 40 for two unlocated ID_EMAIL findings", got)
+	}
+}
+
+func TestDedupeMergesSameSpan(t *testing.T) {
+	findings := []Finding{
+		{Type: "ID_SSN", Offset: 4, Length: 9},
+		{Type: "ID_SSN", Offset: 4, Length: 11},
+		{Type: "ID_SSN", Offset: 30, Length: 9},
+	}
+	got := dedupeFindings(findings)
+	if len(got) != 2 {
+		t.Fatalf("dedupeFindings kept %d findings, want 2", len(got))
+	}
+	if got[0].Length != 11 {
+		t.Fatalf("merged span length = %d, want the widest, 11", got[0].Length)
+	}
+}
@@ -0,0 +1,75 @@
+// Vigilant/proxy/confidence.go
+// FINDING CONFIDENCE: per-type minimums and optional down-weighting
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ConfidenceConfig only changes scoring when Enabled. Findings below the
+// minimum for their type (Min, else DefaultMin) are dropped before scoring;
+// with Weighted, the rest score policy score x confidence.
+type ConfidenceConfig struct {
+	Enabled    bool               `json:"enabled"`
+	DefaultMin float64            `json:"default_min"`
+	Min        map[string]float64 `json:"min"`
+	Weighted   bool               `json:"weighted"`
+}
+
+// confidence is the finding's confidence clamped to [0, 1]. Daemons that
+// don't report one are fully confident.
+func (f Finding) confidence() float64 {
+	if f.Confidence == nil {
+		return 1
+	}
+	return math.Min(1, math.Max(0, *f.Confidence))
+}
+
+func (c ConfidenceConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	check := func(field string, v float64) {
+		if v < 0 || v > 1 || math.IsNaN(v) {
+			problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf("must be between 0 and 1, got %v", v)})
+		}
+	}
+	check("confidence.default_min", c.DefaultMin)
+	types := make([]string, 0, len(c.Min))
+	for t := range c.Min {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		check("confidence.min."+t, c.Min[t])
+	}
+	return problems
+}
+
+// filter drops findings below their type's minimum confidence.
+func (c ConfidenceConfig) filter(findings []Finding) []Finding {
+	if !c.Enabled {
+		return findings
+	}
+	kept := findings[:0:0]
+	for _, f := range findings {
+		min, ok := c.Min[f.Type]
+		if !ok {
+			min = c.DefaultMin
+		}
+		if f.confidence() >= min {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// weight scales a policy score by the finding's confidence when weighting
+// is on.
+func (c ConfidenceConfig) weight(f Finding, score int) int {
+	if !c.Enabled || !c.Weighted {
+		return score
+	}
+	return int(math.Round(float64(score) * f.confidence()))
+}
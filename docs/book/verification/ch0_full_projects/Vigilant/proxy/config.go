@@ -0,0 +1,366 @@
+// Vigilant/proxy/config.go
+// RISK MATRIX PARSING & VALIDATION
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Policy scores each finding of Type. A composite policy sets AllOf or
+// AnyOf instead and adds Score once when all, or any, of those types are
+// found.
+type Policy struct {
+	Type  string   `json:"type,omitempty"`
+	AllOf []string `json:"all_of,omitempty"`
+	AnyOf []string `json:"any_of,omitempty"`
+	Score int      `json:"score"`
+}
+
+type Config struct {
+	Policies   []Policy `json:"policies"`
+	Thresholds struct {
+		Block  int `json:"block"`
+		Redact int `json:"redact"`
+	} `json:"thresholds"`
+	Batch   BatchConfig    `json:"batch"`
+	Daemons []DaemonConfig `json:"daemons"`
+
+	// FDLimits bounds open connections, daemon sockets and files.
+	FDLimits FDLimitConfig `json:"fd_limits"`
+
+	// VerdictExpr, when set, decides the verdict instead of thresholds.block.
+	VerdictExpr string `json:"verdict_expr"`
+	verdict     *verdictExpr
+
+	// PolicySets are selected per request by a signed X-Vigilant-Policy
+	// header; TrustedOverrideKeys are the ed25519 keys allowed to sign it.
+	PolicySets          map[string]PolicySet `json:"policy_sets"`
+	TrustedOverrideKeys []string             `json:"trusted_override_keys"`
+	policySets          map[string]*scoringRules
+	overrideKeys        []ed25519.PublicKey
+
+	// PinnedClientCerts, when set, admits only client certificates with
+	// these SHA-256 fingerprints, on top of the CA check.
+	PinnedClientCerts []string `json:"pinned_client_certs"`
+	pinnedCerts       map[string]bool
+
+	// Audit writes one de-identified record per verdict.
+	Audit AuditConfig `json:"audit"`
+
+	// AccessLog writes one structured record per request.
+	AccessLog AccessLogConfig `json:"access_log"`
+
+	// ScorerChain stages the daemon calls; unset, both run at once.
+	ScorerChain ScorerChain `json:"scorer_chain"`
+
+	// Confidence filters and weights findings by daemon-reported confidence.
+	Confidence ConfidenceConfig `json:"confidence"`
+
+	// Redaction masks finding spans for scores in the redact band.
+	Redaction RedactionConfig `json:"redaction"`
+
+	// Breaker fails fast on daemons that keep failing.
+	Breaker BreakerConfig `json:"circuit_breaker"`
+
+	// Retry retries daemon calls that fail transiently.
+	Retry RetryConfig `json:"retry"`
+
+	// Warm exercises the daemons at startup.
+	Warm WarmConfig `json:"warm"`
+
+	// SeverityScores scores findings by their reported severity
+	// (lowercase keys), ahead of the per-type policy score.
+	SeverityScores map[string]int `json:"severity_scores"`
+
+	// ExposeFindings returns the score, threshold and, for blocks, the
+	// finding types to the client in response headers.
+	ExposeFindings bool `json:"expose_findings"`
+
+	// MaxBodyBytes caps each request body, batches included (0 = 10 MiB).
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+
+	// RequestTimeoutMs bounds the daemon calls for one request (0 = 10s).
+	RequestTimeoutMs int `json:"request_timeout_ms"`
+
+	// Stream enables POST /stream for bodies too large to buffer.
+	Stream StreamConfig `json:"stream"`
+
+	// Cache reuses scan results for repeated payloads.
+	Cache CacheConfig `json:"cache"`
+
+	// RateLimit caps each client's request rate.
+	RateLimit RateLimitConfig `json:"rate_limit"`
+
+	// DedupeFindings scores a finding both daemons report (same type and
+	// offset) once instead of twice.
+	DedupeFindings bool `json:"dedupe_findings"`
+
+	// Quorum combines the scanners' answers and tolerates failed ones.
+	Quorum QuorumConfig `json:"quorum"`
+
+	// Simulate reports verdicts without enforcing them.
+	Simulate SimulateConfig `json:"simulate"`
+
+	// MaxJSONDepth caps object/array nesting in JSON bodies (0 = default).
+	MaxJSONDepth int `json:"max_json_depth"`
+
+	// ScanField selects the part of a JSON body that is scanned.
+	ScanField ScanFieldConfig `json:"scan_field"`
+}
+
+// ConfigProblem is one validation failure, addressed by JSON field path.
+// File is only set when loading a policy directory.
+type ConfigProblem struct {
+	File    string `json:"file,omitempty"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) Error() string {
+	msg := p.Message
+	if p.Field != "" {
+		msg = p.Field + ": " + msg
+	}
+	if p.File != "" {
+		msg = p.File + ": " + msg
+	}
+	return msg
+}
+
+// parseConfig decodes and validates a risk matrix without side effects. It
+// reports every problem found, not just the first; the Config is only usable
+// when no problems are returned.
+func parseConfig(data []byte) (Config, []ConfigProblem) {
+	var cfg Config
+	if problem := decodeJSON(data, &cfg); problem != nil {
+		return cfg, []ConfigProblem{*problem}
+	}
+	return cfg, cfg.validate()
+}
+
+func decodeJSON(data []byte, v any) *ConfigProblem {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	var syn *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syn):
+		return &ConfigProblem{Message: fmt.Sprintf("invalid JSON at byte %d: %v", syn.Offset, err)}
+	case errors.As(err, &typ):
+		return &ConfigProblem{Field: typ.Field, Message: fmt.Sprintf("expected %s, got JSON %s", typ.Type, typ.Value)}
+	}
+	return &ConfigProblem{Message: err.Error()}
+}
+
+func (c *Config) validate() []ConfigProblem {
+	problems := append(requirePolicies(c.Policies), validatePolicies(c.Policies)...)
+	problems = append(problems, c.validateSettings()...)
+	return append(problems, c.checkPolicySetsStricter()...)
+}
+
+// requirePolicies rejects an empty policy list: with nothing to score, every
+// finding passes. Policy sets only override the base list, so they may be empty.
+func requirePolicies(policies []Policy) []ConfigProblem {
+	if len(policies) == 0 {
+		return []ConfigProblem{{Field: "policies", Message: "must list at least one policy (nothing would ever score)"}}
+	}
+	return nil
+}
+
+func validatePolicies(policies []Policy) []ConfigProblem {
+	var problems []ConfigProblem
+	seen := make(map[string]int)
+	for i, p := range policies {
+		field := fmt.Sprintf("policies[%d]", i)
+		switch j, dup := seen[p.Type]; {
+		case p.composite():
+			problems = append(problems, p.validateComposite(field)...)
+		case p.Type == "":
+			problems = append(problems, ConfigProblem{Field: field + ".type", Message: "must not be empty (or set all_of / any_of)"})
+		case dup:
+			problems = append(problems, ConfigProblem{Field: field + ".type", Message: fmt.Sprintf("duplicate type %q (also policies[%d])", p.Type, j)})
+		default:
+			seen[p.Type] = i
+		}
+		if p.Score < 0 {
+			problems = append(problems, ConfigProblem{Field: field + ".score", Message: fmt.Sprintf("must be >= 0, got %d", p.Score)})
+		}
+	}
+	return problems
+}
+
+// validateSettings checks everything except the policy list.
+func (c *Config) validateSettings() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Thresholds.Block <= 0 {
+		add("thresholds.block", "must be > 0, got %d (0 blocks every request)", c.Thresholds.Block)
+	}
+	if c.Thresholds.Redact < 0 {
+		add("thresholds.redact", "must be >= 0, got %d", c.Thresholds.Redact)
+	} else if c.Thresholds.Block > 0 && c.Thresholds.Redact >= c.Thresholds.Block {
+		add("thresholds.redact", "must be < thresholds.block (%d), got %d", c.Thresholds.Block, c.Thresholds.Redact)
+	}
+
+	// Compiling here keeps the hot path free of parsing; validateSettings
+	// runs on every load path, so the compiled form is always in sync.
+	c.verdict = nil
+	if c.VerdictExpr != "" {
+		expr, err := compileVerdictExpr(c.VerdictExpr)
+		if err != nil {
+			add("verdict_expr", "%v", err)
+		} else {
+			c.verdict = expr
+		}
+	}
+	problems = append(problems, c.compilePolicySets()...)
+	problems = append(problems, c.compilePinnedCerts()...)
+	problems = append(problems, c.Audit.validate()...)
+	problems = append(problems, c.AccessLog.validate()...)
+	problems = append(problems, c.ScorerChain.validate(c.scannerNames())...)
+	problems = append(problems, c.Confidence.validate()...)
+	problems = append(problems, c.Redaction.validate()...)
+	problems = append(problems, c.Breaker.validate()...)
+	problems = append(problems, c.Retry.validate()...)
+	problems = append(problems, validateRequestTimeout(c.RequestTimeoutMs)...)
+	problems = append(problems, c.Stream.validate()...)
+	problems = append(problems, c.Cache.validate()...)
+	problems = append(problems, c.RateLimit.validate()...)
+	problems = append(problems, c.validateQuorum()...)
+	c.ScanField.compiled = nil
+	if c.ScanField.Path != "" {
+		path, err := compileJSONPath(c.ScanField.Path)
+		if err != nil {
+			add("scan_field.path", "%v", err)
+		} else if len(path) == 0 {
+			add("scan_field.path", "\"$\" selects the whole body; omit scan_field instead")
+		} else {
+			c.ScanField.compiled = path
+		}
+	}
+	switch c.ScanField.OnMissing {
+	case "", ON_MISSING_ERROR, ON_MISSING_SCAN_BODY:
+	default:
+		add("scan_field.on_missing", "unknown mode %q (want %s or %s)", c.ScanField.OnMissing, ON_MISSING_ERROR, ON_MISSING_SCAN_BODY)
+	}
+	// Finding spans point into the extracted field, not the body the
+	// redaction would be answered with; every redact-band document would
+	// be blocked instead.
+	if c.ScanField.Path != "" && c.Redaction.Enabled {
+		add("redaction.enabled", "can't be combined with scan_field: spans point into %s, not the body (turn one of them off)", c.ScanField.Path)
+	}
+
+	for _, sev := range slices.Sorted(maps.Keys(c.SeverityScores)) {
+		score := c.SeverityScores[sev]
+		if sev == "" || sev != strings.ToLower(sev) {
+			add("severity_scores", "keys must be non-empty and lowercase, got %q", sev)
+		}
+		if score < 0 {
+			add("severity_scores."+sev, "must be >= 0, got %d", score)
+		}
+	}
+
+	seenDaemons := make(map[string]bool)
+	for i, d := range c.Daemons {
+		field := fmt.Sprintf("daemons[%d]", i)
+		builtin := d.Name == DAEMON_SHIELD || d.Name == DAEMON_ANALYST
+		switch {
+		case (d.Shadow || d.Socket != "") && (d.Name == "" || builtin):
+			add(field+".name", "a daemon with its own socket needs its own name, got %q", d.Name)
+		case d.Shadow && d.Socket == "":
+			add(field+".socket", "required for shadow daemons")
+		case !builtin && d.Socket == "":
+			add(field+".name", "unknown daemon %q (want %s or %s, or set socket for an extra scanner)", d.Name, DAEMON_SHIELD, DAEMON_ANALYST)
+		case seenDaemons[d.Name]:
+			add(field+".name", "duplicate daemon %q", d.Name)
+		}
+		seenDaemons[d.Name] = true
+		problems = append(problems, d.Send.validate(field+".send")...)
+		if d.Pool != nil {
+			problems = append(problems, d.Pool.validate(field+".pool")...)
+		}
+	}
+
+	if c.Batch.MaxItems < 0 {
+		add("batch.max_items", "must be >= 0, got %d", c.Batch.MaxItems)
+	}
+	if c.Batch.Concurrency < 0 {
+		add("batch.concurrency", "must be >= 0, got %d", c.Batch.Concurrency)
+	}
+	switch c.Warm.Mode {
+	case "", WARM_OFF, WARM_FOREGROUND, WARM_BACKGROUND:
+	default:
+		add("warm.mode", "must be %q, %q or %q, got %q", WARM_OFF, WARM_FOREGROUND, WARM_BACKGROUND, c.Warm.Mode)
+	}
+	if c.Warm.TimeoutMs < 0 {
+		add("warm.timeout_ms", "must be >= 0, got %d", c.Warm.TimeoutMs)
+	}
+	if c.MaxBodyBytes < 0 {
+		add("max_body_bytes", "must be >= 0, got %d", c.MaxBodyBytes)
+	}
+	if c.MaxJSONDepth < 0 {
+		add("max_json_depth", "must be >= 0, got %d", c.MaxJSONDepth)
+	}
+	if c.FDLimits.Soft < 0 {
+		add("fd_limits.soft", "must be >= 0, got %d", c.FDLimits.Soft)
+	}
+	if c.FDLimits.Hard < 0 {
+		add("fd_limits.hard", "must be >= 0, got %d", c.FDLimits.Hard)
+	}
+	if c.FDLimits.Soft > 0 && c.FDLimits.Hard > 0 && c.FDLimits.Soft > c.FDLimits.Hard {
+		add("fd_limits.soft", "must be <= fd_limits.hard (%d), got %d", c.FDLimits.Hard, c.FDLimits.Soft)
+	}
+	return problems
+}
+
+// policySource is the risk matrix file, or a policy directory.
+var policySource = paths.Policy
+
+// readConfig loads a single risk matrix file or a policy directory. The
+// error is only for I/O failures; content problems are returned separately.
+func readConfig(path string) (Config, []ConfigProblem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	if info.IsDir() {
+		return loadPolicyDir(path)
+	}
+	data, err := readVerified(path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	cfg, problems := parseConfig(data)
+	return cfg, problems, nil
+}
+
+func loadConfig() {
+	cfg, problems, err := readConfig(policySource)
+	if err != nil {
+		log.Fatalf("CONFIG_LOAD_FAIL: %v", err)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Printf("CONFIG_INVALID: %s: %v", policySource, p)
+		}
+		log.Fatalf("CONFIG_LOAD_FAIL: %d problem(s) in %s", len(problems), policySource)
+	}
+	liveConfig.Store(&cfg)
+	if cfg.Simulate.Enabled {
+		logSimulateMode(&cfg)
+	}
+}
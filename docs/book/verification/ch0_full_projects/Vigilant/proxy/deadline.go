@@ -0,0 +1,37 @@
+// Vigilant/proxy/deadline.go
+// DEADLINES: bound every scan by the request, and by request_timeout_ms
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const DEFAULT_REQUEST_TIMEOUT = 10 * time.Second
+
+func (c *Config) requestTimeout() time.Duration {
+	if c.RequestTimeoutMs <= 0 {
+		return DEFAULT_REQUEST_TIMEOUT
+	}
+	return time.Duration(c.RequestTimeoutMs) * time.Millisecond
+}
+
+func validateRequestTimeout(ms int) []ConfigProblem {
+	if ms < 0 {
+		return []ConfigProblem{{Field: "request_timeout_ms", Message: fmt.Sprintf("must be >= 0, got %d", ms)}}
+	}
+	return nil
+}
+
+// watchConn bounds conn's I/O by ctx: it takes ctx's deadline, and canceling
+// ctx fails a blocked read or write at once. stop ends the watch; it reports
+// false if ctx fired first, in which case conn must not be reused.
+func watchConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+}
@@ -0,0 +1,217 @@
+// Vigilant/proxy/fdlimit.go
+// FILE DESCRIPTOR BUDGET: track connections, daemon sockets and files
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Descriptor kinds counted by the tracker.
+const (
+	FD_CONN   = "conn"
+	FD_DAEMON = "daemon"
+	FD_FILE   = "file"
+)
+
+// Without fd_limits in the config, the limits are these fractions of
+// RLIMIT_NOFILE, leaving headroom for descriptors the gateway doesn't track
+// (stdio, log files, the Go runtime's own).
+const (
+	FD_SOFT_PERCENT = 70
+	FD_HARD_PERCENT = 90
+	FD_FALLBACK_MAX = 1024
+)
+
+var errFDLimit = errors.New("FD_LIMIT_REACHED")
+
+type FDLimitConfig struct {
+	Soft int `json:"soft"`
+	Hard int `json:"hard"`
+}
+
+// limits resolves the configured limits, deriving unset ones from the
+// process's RLIMIT_NOFILE.
+func (c FDLimitConfig) limits() (soft, hard int64) {
+	max := int64(FD_FALLBACK_MAX)
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err == nil && rl.Cur > 0 && rl.Cur < 1<<31 {
+		max = int64(rl.Cur)
+	}
+	soft, hard = int64(c.Soft), int64(c.Hard)
+	if hard <= 0 {
+		hard = max * FD_HARD_PERCENT / 100
+	}
+	if soft <= 0 {
+		soft = hard * FD_SOFT_PERCENT / FD_HARD_PERCENT
+	}
+	if soft > hard {
+		soft = hard
+	}
+	return soft, hard
+}
+
+// FDStats is the tracker's view exposed on /debug/state.
+type FDStats struct {
+	Open   int64            `json:"open"`
+	ByKind map[string]int64 `json:"by_kind"`
+	Soft   int64            `json:"soft_limit"`
+	Hard   int64            `json:"hard_limit"`
+	Shed   int64            `json:"shed"`
+}
+
+type fdTracker struct {
+	open   atomic.Int64
+	shed   atomic.Int64
+	warned atomic.Bool
+	mu     sync.Mutex
+	byKind map[string]int64
+}
+
+var fds = &fdTracker{byKind: make(map[string]int64)}
+
+// acquire counts one descriptor of the given kind. Descriptors the gateway
+// can refuse (daemon dials, files) pass enforce; accepted connections already
+// exist and are only counted.
+func (t *fdTracker) acquire(kind string, enforce bool) (release func(), err error) {
+	soft, hard := currentConfig().FDLimits.limits()
+	n := t.open.Add(1)
+	if enforce && n > hard {
+		t.open.Add(-1)
+		t.shed.Add(1)
+		return nil, errFDLimit
+	}
+	if n >= soft && t.warned.CompareAndSwap(false, true) {
+		log.Printf("[FD_WARN] %d descriptors open (soft limit %d, hard limit %d)", n, soft, hard)
+	}
+	t.mu.Lock()
+	t.byKind[kind]++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if t.open.Add(-1) < soft {
+				t.warned.Store(false)
+			}
+			t.mu.Lock()
+			t.byKind[kind]--
+			t.mu.Unlock()
+		})
+	}, nil
+}
+
+// overHard reports whether new work should be shed.
+func (t *fdTracker) overHard() bool {
+	_, hard := currentConfig().FDLimits.limits()
+	return t.open.Load() >= hard
+}
+
+func (t *fdTracker) Stats() FDStats {
+	soft, hard := currentConfig().FDLimits.limits()
+	s := FDStats{Open: t.open.Load(), Soft: soft, Hard: hard, Shed: t.shed.Load(), ByKind: make(map[string]int64)}
+	t.mu.Lock()
+	for k, v := range t.byKind {
+		s.ByKind[k] = v
+	}
+	t.mu.Unlock()
+	return s
+}
+
+// trackedConn releases its descriptor slot on Close. net/http closes each
+// accepted connection exactly once, but the release is idempotent regardless.
+type trackedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// CloseWrite passes through to the underlying socket so daemons still see EOF.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// fdListener counts every accepted connection against the budget.
+type fdListener struct {
+	net.Listener
+}
+
+func (l fdListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	release, _ := fds.acquire(FD_CONN, false)
+	return &trackedConn{Conn: conn, release: release}, nil
+}
+
+// dialDaemon opens a daemon socket within the descriptor budget, giving up
+// after timeout or when ctx is done.
+func dialDaemon(ctx context.Context, sockPath string, timeout time.Duration) (net.Conn, error) {
+	release, err := fds.acquire(FD_DAEMON, true)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "unix", sockPath)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &trackedConn{Conn: conn, release: release}, nil
+}
+
+// trackedFile releases its descriptor slot on Close.
+type trackedFile struct {
+	*os.File
+	release func()
+}
+
+func (f *trackedFile) Close() error {
+	f.release()
+	return f.File.Close()
+}
+
+// openFile opens path read-only within the descriptor budget.
+func openFile(path string) (*trackedFile, error) {
+	release, err := fds.acquire(FD_FILE, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &trackedFile{File: f, release: release}, nil
+}
+
+// withFDLimit sheds requests with 503 once the hard limit is reached, before
+// they dial any daemon.
+func withFDLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fds.overHard() {
+			fds.shed.Add(1)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,21 +4,33 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"os"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const GATEWAY_VERSION = "3.1"
+
+// Development defaults; see paths.go for the environment overrides.
 const (
 	SHIELD_SOCK  = "/data/data/com.termux/files/usr/tmp/v_s.sock"
 	ANALYST_SOCK = "/data/data/com.termux/files/usr/tmp/v_a.sock"
@@ -28,123 +40,444 @@ const (
 	CA_CERT     = "/data/data/com.termux/files/home/.naab/language/docs/book/verification/ch0_full_projects/Vigilant/config/ca_cert.pem"
 	SERVER_CERT = "/data/data/com.termux/files/home/.naab/language/docs/book/verification/ch0_full_projects/Vigilant/config/server_cert.pem"
 	SERVER_KEY  = "/data/data/com.termux/files/home/.naab/language/docs/book/verification/ch0_full_projects/Vigilant/config/server_key.pem"
+	CLIENT_CERT = "/data/data/com.termux/files/home/.naab/language/docs/book/verification/ch0_full_projects/Vigilant/config/client_cert.pem"
+	CLIENT_KEY  = "/data/data/com.termux/files/home/.naab/language/docs/book/verification/ch0_full_projects/Vigilant/config/client_key.pem"
 	
-	// Legacy Auth (Secondary Layer)
+	// Legacy Auth (Secondary Layer), refused in production mode
 	SOVEREIGN_KEY = "VIGILANT_SOVEREIGN_DEBUG_KEY_12345"
-)
-
-type Policy struct {
-	Type   string `json:"type"`
-	Score  int    `json:"score"`
-}
 
-type Config struct {
-	Policies   []Policy `json:"policies"`
-	Thresholds struct {
-		Block  int `json:"block"`
-		Redact int `json:"redact"`
-	} `json:"thresholds"`
-}
+	// Directory of secret files; when set, secrets are never read from constants.
+	SECRETS_DIR_ENV = "VIGILANT_SECRETS_DIR"
+)
 
 type Finding struct {
 	Type string `json:"type"`
+
+	// Offset and Length locate the finding in the scanned content (bytes).
+	// A zero Length means the daemon reported no span.
+	Offset int `json:"offset,omitempty"`
+	Length int `json:"length,omitempty"`
+
+	// Confidence is optional (0.0-1.0); absent means 1.0.
+	Confidence *float64 `json:"confidence,omitempty"`
+
+	// Severity, when it matches severity_scores, scores the finding instead
+	// of its type. Message and RuleID are carried through for audit; daemons
+	// that only send a type leave all three empty.
+	Severity string `json:"severity,omitempty"`
+	Message  string `json:"message,omitempty"`
+	RuleID   string `json:"rule_id,omitempty"`
 }
 
-var globalConfig Config
+// liveConfig holds the active config. Readers take one snapshot per request
+// with currentConfig; a reload swaps in a fully validated replacement.
+var liveConfig atomic.Pointer[Config]
+
+func init() { liveConfig.Store(&Config{}) }
 
-func loadConfig() {
-	data, err := os.ReadFile(POLICY_FILE)
-	if err != nil { log.Fatalf("CONFIG_LOAD_FAIL: %v", err) }
-	json.Unmarshal(data, &globalConfig)
+func currentConfig() *Config { return liveConfig.Load() }
+
+// secretStore is nil when VIGILANT_SECRETS_DIR is unset (legacy debug mode).
+var secretStore *SecretStore
+
+// authKey returns the expected X-Vigilant-Auth value.
+func authKey() (string, error) {
+	if secretStore == nil {
+		return envOr(AUTH_KEY_ENV, SOVEREIGN_KEY), nil
+	}
+	key, err := secretStore.Get(SECRET_AUTH_KEY)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("SECRET_EMPTY: %s", SECRET_AUTH_KEY)
+	}
+	return string(key), nil
 }
 
-func verifyIntegrity(path string) string {
-	f, _ := os.Open(path)
+// verifyIntegrity returns the SHA-256 of the file at path. A file that
+// can't be read is an error, never the digest of empty input.
+func verifyIntegrity(path string) (string, error) {
+	f, err := openFile(path)
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
 	h := sha256.New()
-	io.Copy(h, f)
-	return hex.EncodeToString(h.Sum(nil))
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func scanWithDaemon(sockPath string, data []byte) ([]Finding, error) {
-	conn, err := net.DialTimeout("unix", sockPath, 1*time.Second)
+// binaryIntegrity digests the running executable. os.Args[0] is not a path
+// when the gateway was started through $PATH.
+func binaryIntegrity() string {
+	exe, err := os.Executable()
+	if err == nil {
+		var sum string
+		if sum, err = verifyIntegrity(exe); err == nil {
+			return sum
+		}
+	}
+	log.Fatalf("INTEGRITY_FAIL: %v", err)
+	return ""
+}
+
+func scanWithDaemon(ctx context.Context, sockPath string, data []byte) ([]Finding, error) {
+	conn, err := dialDaemon(ctx, sockPath, 1*time.Second)
 	if err != nil { return nil, err }
 	defer conn.Close()
+	defer watchConn(ctx, conn)()
 
-	conn.Write(data)
-	if cw, ok := conn.(*net.UnixConn); ok { cw.CloseWrite() }
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
 
-	resp, _ := io.ReadAll(conn)
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
 	var findings []Finding
 	json.Unmarshal(resp, &findings)
 	return findings, nil
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	// mTLS already verified the Identity.
-	// We check the API Key as a second factor (Defense in Depth).
+func traceDaemon(span *Span, sock string, findings []Finding, err error) {
+	span.SetAttr("vigilant.daemon.socket", sock)
+	span.SetAttr("vigilant.findings", strconv.Itoa(len(findings)))
+	span.SetError(err)
+	span.End()
+}
+
+// ScanResult is the scoring outcome for one document.
+type ScanResult struct {
+	Verdict  string    `json:"verdict"`
+	Score    int       `json:"score"`
+	Findings []Finding `json:"-"`
+
+	// Threshold is the block threshold of the policy that scored it.
+	Threshold int `json:"-"`
+
+	// Redacted is the masked body for VERDICT_REDACT.
+	Redacted []byte `json:"-"`
+
+	// Simulated marks a verdict that is reported but not enforced.
+	Simulated bool `json:"-"`
+
+	// Partial marks a verdict some daemon didn't contribute to (quorum met
+	// without it, or its circuit open under fail_open). It is never cached.
+	Partial bool `json:"-"`
+}
+
+const (
+	VERDICT_PASS  = "SECURE_PASS"
+	VERDICT_BLOCK = "SECURITY_BLOCK"
+)
+
+var errDaemonUnavailable = errors.New("DAEMON_UNAVAILABLE")
+
+// scanDocument runs the document through the scorer chain and scores the findings.
+func scanDocument(ctx context.Context, body []byte) (ScanResult, error) {
+	cfg := currentConfig()
+	if err := cfg.checkJSONDepth(body); err != nil {
+		return ScanResult{}, err
+	}
+	content, err := cfg.scanContent(body)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	rules := rulesFrom(ctx, cfg)
+	key := cacheKey{rules: rules.name, digest: sha256.Sum256(content)}
+	res, hit := scanCache.get(cfg, key)
+	if !hit {
+		ctx = withRecording(ctx, key.digest)
+		res, err = runChain(ctx, rules, content)
+		if errors.Is(err, errCircuitOpen) {
+			// on_open fail_closed: what a circuit-open daemon can't clear is
+			// blocked. Not cached: the circuit closes again.
+			log.Printf("[BREAKER_BLOCK] Circuit open, blocking unscanned document")
+			return ScanResult{Verdict: VERDICT_BLOCK, Threshold: rules.block}, nil
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+		res.Threshold = rules.block
+		if !res.Partial {
+			scanCache.put(cfg, key, res)
+		}
+		runShadows(content, rules, res)
+	}
+	applyRedaction(cfg, &res, body, content)
+	if !hit {
+		recordVerdict(ctx, rules, res)
+	}
+	return res, nil
+}
+
+// authorize checks the API Key as a second factor (Defense in Depth).
+// mTLS already verified the Identity. On failure the response is written.
+func authorize(w http.ResponseWriter, r *http.Request) bool {
+	expected, err := authKey()
+	if err != nil {
+		log.Printf("[AUTH_KEY_UNAVAILABLE] %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
 	clientKey := r.Header.Get("X-Vigilant-Auth")
-	if clientKey != SOVEREIGN_KEY {
+	if subtle.ConstantTimeCompare([]byte(clientKey), []byte(expected)) != 1 {
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return false
 	}
+	return true
+}
 
-	body, _ := io.ReadAll(r.Body)
+const (
+	SCORE_HEADER     = "X-Vigilant-Score"
+	THRESHOLD_HEADER = "X-Vigilant-Threshold"
+	FINDINGS_HEADER  = "X-Vigilant-Findings"
+)
 
-	var wg sync.WaitGroup
-	var rustFindings, pyFindings []Finding
-	var rErr, pErr error
+// exposeScore sets the score headers when expose_findings is on. With no
+// result (the scan failed) only the threshold is known. Call it before
+// WriteHeader.
+func exposeScore(w http.ResponseWriter, r *http.Request, res *ScanResult) {
+	cfg := currentConfig()
+	if !cfg.ExposeFindings {
+		return
+	}
+	if res == nil {
+		w.Header().Set(THRESHOLD_HEADER, strconv.Itoa(rulesFrom(r.Context(), cfg).block))
+		return
+	}
+	w.Header().Set(THRESHOLD_HEADER, strconv.Itoa(res.Threshold))
+	w.Header().Set(SCORE_HEADER, strconv.Itoa(res.Score))
+	if res.Verdict == VERDICT_BLOCK && len(res.Findings) > 0 {
+		types := slices.Sorted(maps.Keys(findingTypes(res.Findings)))
+		w.Header().Set(FINDINGS_HEADER, strings.Join(types, ","))
+	}
+}
 
-	wg.Add(2)
-	go func() { defer wg.Done(); rustFindings, rErr = scanWithDaemon(SHIELD_SOCK, body) }()
-	go func() { defer wg.Done(); pyFindings, pErr = scanWithDaemon(ANALYST_SOCK, body) }()
-	wg.Wait()
+// handler is the single-document scan endpoint. Auth runs as middleware.
+func handler(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, currentConfig())
+	if !ok {
+		return
+	}
+	r = confirmOverride(r, sha256.Sum256(body))
 
-	if rErr != nil || pErr != nil {
+	ctx, cancel := context.WithTimeout(r.Context(), currentConfig().requestTimeout())
+	defer cancel()
+	res, err := scanDocument(ctx, body)
+	if err != nil {
+		exposeScore(w, r, nil)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("[SCAN_TIMEOUT] %s: daemons didn't answer within %s", r.URL.Path, currentConfig().requestTimeout())
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errUnencodablePayload) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errScanFieldMissing) || errors.Is(err, errJSONTooDeep) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	all := append(rustFindings, pyFindings...)
-	totalScore := 0
-	for _, f := range all {
-		for _, p := range globalConfig.Policies {
-			if f.Type == p.Type { totalScore += p.Score }
-		}
-	}
+	res.Simulated = simulating(r, currentConfig())
+	signVerdict(w, res, body)
+	recentVerdicts.Add(w.Header().Get("X-Request-ID"), r.URL.Path, res)
+	auditScan(r, w.Header().Get("X-Request-ID"), r.URL.Path, body, res)
+	metrics.countVerdict("/", res)
+	noteVerdict(r.Context(), res)
+	writeVerdict(w, r, res)
+}
 
-	if totalScore >= globalConfig.Thresholds.Block {
-		log.Printf("[SECURITY_BLOCK] Score: %d", totalScore)
+// writeVerdict answers a scored request: 403 for a block, the masked body
+// for a redaction, otherwise a pass. Simulated verdicts always get 200. Verdict headers must already be set.
+func writeVerdict(w http.ResponseWriter, r *http.Request, res ScanResult) {
+	if res.Simulated {
+		writeSimulated(w, r, res)
+		return
+	}
+	exposeScore(w, r, &res)
+	if res.Verdict == VERDICT_BLOCK {
+		log.Printf("[SECURITY_BLOCK] Score: %d", res.Score)
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("{\"error\": \"Enterprise Policy Violation\"}"))
 		return
 	}
 
+	if res.Verdict == VERDICT_REDACT {
+		log.Printf("[SECURITY_REDACT] Score: %d, %d span(s) masked", res.Score, len(res.Findings))
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Set("X-Vigilant-Redacted", strconv.Itoa(len(res.Findings)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(res.Redacted)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"status\": \"SECURE_PASS\"}"))
 }
 
+// initSecrets wires the secret store from VIGILANT_SECRETS_DIR and makes
+// sure the auth key is readable before anything depends on it.
+func initSecrets() {
+	dir := os.Getenv(SECRETS_DIR_ENV)
+	if dir == "" {
+		if os.Getenv(AUTH_KEY_ENV) == "" {
+			log.Printf("[WARN] %s and %s unset; using compiled debug auth key", SECRETS_DIR_ENV, AUTH_KEY_ENV)
+		}
+		return
+	}
+	secretStore = NewSecretStore(dir)
+	if _, err := authKey(); err != nil {
+		log.Fatalf("SECRET_LOAD_FAIL: %v", err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "support-bundle":
+			os.Exit(runSupportBundle(os.Args[2:]))
+		case "audit-decrypt":
+			os.Exit(runAuditDecrypt(os.Args[2:]))
+		case "scan":
+			os.Exit(runScan(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
+	listenDefault := DEFAULT_LISTEN
+	if v := os.Getenv(LISTEN_ENV); v != "" {
+		listenDefault = v
+	}
+	alpnDefault := DEFAULT_ALPN
+	if v := os.Getenv(ALPN_ENV); v != "" {
+		alpnDefault = v
+	}
+	healthDefault := os.Getenv(HEALTH_LISTEN_ENV)
+	flag.StringVar(&policySource, "policy", paths.Policy, "risk matrix file, or a policy directory with "+POLICY_BASE_FILE+" (env "+POLICY_DIR_ENV+" or "+POLICY_FILE_ENV+")")
+	listenSpec := flag.String("listen", listenDefault, "comma-separated host:port list to bind (host may be an IP or interface name; env "+LISTEN_ENV+")")
+	alpnSpec := flag.String("alpn", alpnDefault, "comma-separated ALPN protocols to offer, in preference order: h2, http/1.1 (env "+ALPN_ENV+")")
+	healthSpec := flag.String("health-listen", healthDefault, "comma-separated host:port list for plain-HTTP /healthz and /readyz, no client certificate needed (env "+HEALTH_LISTEN_ENV+")")
+	reloadInterval := flag.Duration("reload-interval", DEFAULT_RELOAD_INTERVAL, "how often to check the policy files for changes (0 = only on SIGHUP)")
+	shutdownGrace := flag.Duration("shutdown-grace", DEFAULT_SHUTDOWN_GRACE, "how long SIGTERM waits for in-flight requests before closing them")
+	recordPath := flag.String("record", os.Getenv(RECORD_ENV), "append each daemon call's request digest and findings to this JSONL file for the replay command (env "+RECORD_ENV+")")
+	captureBodies := flag.Bool("capture-bodies", false, "with -record, also write the raw bytes sent to each daemon")
+	insecureDev := flag.Bool("insecure-dev", false, "DANGEROUS: serve plain HTTP without mTLS for local testing (needs "+INSECURE_DEV_ACK_ENV+")")
+	flag.Parse()
+	requireProductionSafe(*insecureDev)
+	if *insecureDev {
+		requireInsecureDevAck()
+	}
+	listenAddrs, err := parseListenAddrs(*listenSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alpn, err := parseALPN(*alpnSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var healthAddrs []string
+	if *healthSpec != "" {
+		if healthAddrs, err = parseListenAddrs(*healthSpec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	initIntegrity(!*insecureDev)
 	loadConfig()
-	fmt.Printf("VIGILANT v3.1 [mTLS_ENABLED] Integrity: %s\n", verifyIntegrity(os.Args[0]))
+	initSecrets()
+	initTracing()
+	initAudit()
+	initAccessLog()
+	initRecording(*recordPath, *captureBodies)
+	if verdictSigner, err = loadVerdictSigner(secretStore); err != nil {
+		log.Fatalf("SECRET_LOAD_FAIL: %v", err)
+	}
+	if verdictSigner != nil {
+		log.Printf("[SIGNING] Verdicts signed with ed25519 key %s (public key %s)",
+			verdictSigner.keyID, base64.StdEncoding.EncodeToString(verdictSigner.PublicKey()))
+	}
+	server := &http.Server{Handler: newRouter(), BaseContext: baseContext}
+	serve := func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+	if *insecureDev {
+		fmt.Printf("VIGILANT v%s [INSECURE_DEV_NO_TLS] Integrity: %s\n", GATEWAY_VERSION, binaryIntegrity())
+		server.Handler = withInsecureDevWarning(server.Handler)
+		serve = server.Serve
+	} else {
+		fmt.Printf("VIGILANT v%s [mTLS_ENABLED] Integrity: %s\n", GATEWAY_VERSION, binaryIntegrity())
+
+		// mTLS Configuration
+		// Read once, through the manifest check, so the files verified are
+		// the files served.
+		caCert, err := readVerified(paths.CACert)
+		if err != nil { log.Fatal(err) }
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		certPEM, err := readVerified(paths.ServerCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyPEM, err := readVerified(paths.ServerKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	// mTLS Configuration
-	caCert, err := os.ReadFile(CA_CERT)
-	if err != nil { log.Fatal(err) }
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    caCertPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert, // THE IRON GATE
+			MinVersion:   tls.VersionTLS13,
 
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert, // THE IRON GATE
-		MinVersion: tls.VersionTLS13,
+			VerifyPeerCertificate: verifyPinnedPeer,
+		}
+		applyALPN(server, alpn)
 	}
 
-	server := &http.Server{
-		Addr:      ":8091",
-		Handler:   http.HandlerFunc(handler),
-		TLSConfig: tlsConfig,
+	// Probes come up before the warm phase so liveness holds while it runs.
+	healthListeners, err := listenAll(healthAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	errc := make(chan error, len(listenAddrs)+len(healthListeners))
+	healthServer := &http.Server{Handler: newHealthMux()}
+	for _, l := range healthListeners {
+		log.Printf("[LISTEN] %s (health probes, plain HTTP)", l.Addr())
+		go func(l net.Listener) { serveErr(errc, healthServer.Serve(fdListener{l})) }(l)
 	}
 
-	log.Fatal(server.ListenAndServeTLS(SERVER_CERT, SERVER_KEY))
+	watchConfig(*reloadInterval)
+	startWarm(currentConfig().Warm)
+	listeners, err := listenAll(listenAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range listeners {
+		log.Printf("[LISTEN] %s", l.Addr())
+		go func(l net.Listener) { serveErr(errc, serve(fdListener{l})) }(l)
+	}
+	serveUntilSignal(errc, *shutdownGrace, server, healthServer)
 }
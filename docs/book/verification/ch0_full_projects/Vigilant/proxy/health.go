@@ -0,0 +1,68 @@
+// Vigilant/proxy/health.go
+// HEALTH PROBES: liveness and daemon readiness for orchestrators
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const HEALTH_LISTEN_ENV = "VIGILANT_HEALTH_LISTEN"
+
+type ReadyStatus struct {
+	Ready    bool           `json:"ready"`
+	Warming  bool           `json:"warming,omitempty"`
+	Draining bool           `json:"draining,omitempty"`
+	Failed   []DaemonStatus `json:"failed,omitempty"`
+}
+
+type HealthStatus struct {
+	Status   string         `json:"status"`
+	Breakers []BreakerStats `json:"breakers,omitempty"`
+}
+
+// healthzHandler answers 200 while the process can serve HTTP at all. An
+// open circuit is reported but doesn't fail liveness; restarting the gateway
+// wouldn't fix the daemon.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthStatus{Status: "ok", Breakers: breakers.Snapshot()})
+}
+
+// readyzHandler answers 200 only when every scanning daemon accepts a
+// connection, no background warm phase is running and the gateway is not
+// shutting down. Shadow daemons are not required.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	st := ReadyStatus{Warming: !warmed.Load(), Draining: draining.Load()}
+	for _, d := range probeDaemons() {
+		if !d.Reachable {
+			st.Failed = append(st.Failed, d)
+		}
+	}
+	st.Ready = !st.Warming && !st.Draining && len(st.Failed) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// healthRoutes mounts the probes and /metrics on mux. They skip auth and
+// the request log, since load balancers and scrapers call them every few
+// seconds without a key.
+func healthRoutes(mux *http.ServeMux) {
+	probe := []middleware{withMethods(http.MethodGet, http.MethodHead)}
+	mux.Handle("/healthz", chain(http.HandlerFunc(healthzHandler), probe...))
+	mux.Handle("/readyz", chain(http.HandlerFunc(readyzHandler), probe...))
+	mux.Handle("/metrics", chain(http.HandlerFunc(metricsHandler), probe...))
+}
+
+// newHealthMux serves only the probes and metrics, for the plain-HTTP
+// -health-listen port that needs no client certificate.
+func newHealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	healthRoutes(mux)
+	return mux
+}
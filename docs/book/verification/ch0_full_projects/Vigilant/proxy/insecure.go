@@ -0,0 +1,33 @@
+// Vigilant/proxy/insecure.go
+// INSECURE DEV MODE: plain HTTP for local testing only, never in production
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+// The mode refuses to start unless this variable holds exactly this value, so
+// a stray flag in a unit file can't silently drop mTLS.
+const (
+	INSECURE_DEV_ACK_ENV   = "VIGILANT_INSECURE_DEV_ACK"
+	INSECURE_DEV_ACK_VALUE = "I_UNDERSTAND_THIS_DISABLES_MTLS"
+)
+
+func requireInsecureDevAck() {
+	if os.Getenv(INSECURE_DEV_ACK_ENV) != INSECURE_DEV_ACK_VALUE {
+		log.Fatalf("INSECURE_DEV_REFUSED: --insecure-dev serves plain HTTP without client certificates; set %s=%s to acknowledge",
+			INSECURE_DEV_ACK_ENV, INSECURE_DEV_ACK_VALUE)
+	}
+	log.Printf("[ERROR] INSECURE_DEV: mTLS is DISABLED. Plain HTTP, no client certificates. Never expose this listener.")
+}
+
+// withInsecureDevWarning logs at ERROR for every request served without TLS.
+func withInsecureDevWarning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[ERROR] INSECURE_DEV: %s %s from %s served over plain HTTP without mTLS", r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
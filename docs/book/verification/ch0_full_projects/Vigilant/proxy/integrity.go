@@ -0,0 +1,195 @@
+// Vigilant/proxy/integrity.go
+// INTEGRITY MANIFEST: refuse policy files and PKI that don't match their digests
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	INTEGRITY_MANIFEST_ENV = "VIGILANT_INTEGRITY_MANIFEST"
+	INTEGRITY_PUBKEY_ENV   = "VIGILANT_INTEGRITY_PUBKEY"
+	INTEGRITY_SIG_SUFFIX   = ".sig"
+)
+
+// integrityManifest maps absolute paths to their expected SHA-256, in
+// sha256sum format: "<hex>  <path>" per line, relative paths resolved
+// against the manifest's directory.
+type integrityManifest struct {
+	path    string
+	digests map[string]string
+}
+
+// integrity is nil unless INTEGRITY_MANIFEST_ENV is set. It is only
+// replaced at startup and by reloadConfig, which run one at a time.
+var integrity *integrityManifest
+
+// loadManifest reads and parses the manifest. With INTEGRITY_PUBKEY_ENV set,
+// the manifest must carry an ed25519 signature over its exact bytes in
+// path+".sig" (hex or base64), so whoever can swap a policy file can't
+// simply rewrite the manifest to match.
+func loadManifest(path string) (*integrityManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if text := os.Getenv(INTEGRITY_PUBKEY_ENV); text != "" {
+		key, err := parsePublicKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", INTEGRITY_PUBKEY_ENV, err)
+		}
+		sigText, err := os.ReadFile(path + INTEGRITY_SIG_SUFFIX)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := decodeKeyText(string(sigText))
+		if err != nil || !ed25519.Verify(key, data, sig) {
+			return nil, fmt.Errorf("%s: signature does not verify against %s", path, INTEGRITY_PUBKEY_ENV)
+		}
+	}
+
+	m := &integrityManifest{path: path, digests: make(map[string]string)}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, file, ok := strings.Cut(line, " ")
+		file = strings.TrimPrefix(strings.TrimLeft(file, " "), "*")
+		if raw, err := hex.DecodeString(sum); !ok || err != nil || len(raw) != sha256.Size || file == "" {
+			return nil, fmt.Errorf("%s:%d: want \"<sha256 hex>  <path>\"", path, n)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		m.digests[absPath(file)] = strings.ToLower(sum)
+	}
+	return m, nil
+}
+
+// absPath is the key a file is listed under: absolute, with symlinks
+// resolved, so the manifest and the gateway may name it differently.
+func absPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// check compares data, just read from path, with the manifest. Checking the
+// bytes actually used leaves no window to swap the file after the check.
+func (m *integrityManifest) check(path string, data []byte) error {
+	want, ok := m.digests[absPath(path)]
+	if !ok {
+		return fmt.Errorf("INTEGRITY_UNLISTED: %s is not in %s", path, m.path)
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("INTEGRITY_MISMATCH: %s has digest %s, %s expects %s", path, got, m.path, want)
+	}
+	return nil
+}
+
+// verifyAll checks that every file in required is listed, and that every
+// listed file exists and matches. A deleted policy file fails here.
+func (m *integrityManifest) verifyAll(required []string) error {
+	for _, p := range required {
+		if _, ok := m.digests[absPath(p)]; !ok {
+			return fmt.Errorf("INTEGRITY_UNLISTED: %s is not in %s", p, m.path)
+		}
+	}
+	files := make([]string, 0, len(m.digests))
+	for p := range m.digests {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+	for _, p := range files {
+		got, err := verifyIntegrity(p)
+		if err != nil {
+			return fmt.Errorf("INTEGRITY_MISSING: %v", err)
+		}
+		if got != m.digests[p] {
+			return fmt.Errorf("INTEGRITY_MISMATCH: %s has digest %s, %s expects %s", p, got, m.path, m.digests[p])
+		}
+	}
+	return nil
+}
+
+// policyFiles is the policy file, or every *.json in a policy directory.
+func policyFiles(source string) []string {
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		matches, _ := filepath.Glob(filepath.Join(source, "*.json"))
+		var files []string
+		for _, m := range matches {
+			if !strings.HasPrefix(filepath.Base(m), ".") {
+				files = append(files, m)
+			}
+		}
+		return files
+	}
+	return []string{source}
+}
+
+// readVerified reads a policy or PKI file, refusing it when a manifest is
+// loaded and the content doesn't match.
+func readVerified(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if integrity != nil {
+		if err := integrity.check(path, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// refreshIntegrity re-reads the manifest named by INTEGRITY_MANIFEST_ENV and
+// verifies it covers the policy files, plus the PKI when tls is set. It
+// leaves the current manifest in place on failure.
+func refreshIntegrity(tls bool) error {
+	path := os.Getenv(INTEGRITY_MANIFEST_ENV)
+	if path == "" {
+		return nil
+	}
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+	required := policyFiles(policySource)
+	if tls {
+		required = append(required, paths.CACert, paths.ServerCert, paths.ServerKey)
+	}
+	if err := m.verifyAll(required); err != nil {
+		return err
+	}
+	integrity = m
+	return nil
+}
+
+// initIntegrity runs before anything reads a policy or PKI file. The PKI is
+// only read at startup, so only the startup check requires it.
+func initIntegrity(tls bool) {
+	if err := refreshIntegrity(tls); err != nil {
+		log.Fatalf("INTEGRITY_FAIL: %v", err)
+	}
+	if integrity != nil {
+		log.Printf("[INTEGRITY] %d file(s) match %s", len(integrity.digests), integrity.path)
+	}
+}
@@ -0,0 +1,90 @@
+// Vigilant/proxy/jsondepth.go
+// NESTING LIMIT: reject deeply nested JSON before anything parses it
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const DEFAULT_MAX_JSON_DEPTH = 64
+
+var errJSONTooDeep = errors.New("JSON_TOO_DEEP")
+
+func (c *Config) maxJSONDepth() int {
+	if c.MaxJSONDepth <= 0 {
+		return DEFAULT_MAX_JSON_DEPTH
+	}
+	return c.MaxJSONDepth
+}
+
+// jsonDepthExceeds reports whether body nests objects or arrays more than
+// max levels deep. It is a single forward pass over the bytes that tracks
+// only string state and bracket depth, so it stops at the first byte past the
+// limit and never builds a value. Bodies that don't start with '{' or '[' are
+// not JSON documents as far as the limit is concerned and always pass.
+func jsonDepthExceeds(body []byte, max int) bool {
+	d := depthScanner{max: max}
+	_, err := d.Write(body)
+	return err != nil
+}
+
+// depthScanner is jsonDepthExceeds as an io.Writer, for bodies that arrive
+// in pieces. Write fails with errJSONTooDeep once the limit is passed.
+type depthScanner struct {
+	max               int
+	started, isJSON   bool
+	depth             int
+	inString, escaped bool
+}
+
+func (d *depthScanner) Write(p []byte) (int, error) {
+	i := 0
+	if !d.started {
+		for i < len(p) && (p[i] == ' ' || p[i] == '\t' || p[i] == '\r' || p[i] == '\n') {
+			i++
+		}
+		if i == len(p) {
+			return len(p), nil
+		}
+		d.started, d.isJSON = true, p[i] == '{' || p[i] == '['
+	}
+	if !d.isJSON {
+		return len(p), nil
+	}
+	for ; i < len(p); i++ {
+		b := p[i]
+		if d.inString {
+			switch {
+			case d.escaped:
+				d.escaped = false
+			case b == '\\':
+				d.escaped = true
+			case b == '"':
+				d.inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			d.inString = true
+		case '{', '[':
+			d.depth++
+			if d.depth > d.max {
+				return i, fmt.Errorf("%w: nesting exceeds %d levels", errJSONTooDeep, d.max)
+			}
+		case '}', ']':
+			d.depth--
+		}
+	}
+	return len(p), nil
+}
+
+// checkJSONDepth enforces max_json_depth on a request body.
+func (c *Config) checkJSONDepth(body []byte) error {
+	if max := c.maxJSONDepth(); jsonDepthExceeds(body, max) {
+		return fmt.Errorf("%w: nesting exceeds %d levels", errJSONTooDeep, max)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Vigilant/proxy/jsondepth_test.go
+// NESTING LIMIT: exact bounds, and brackets that don't count
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func nested(depth int) string {
+	return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+}
+
+func TestJSONDepthLimit(t *testing.T) {
+	tests := []struct {
+		name, body string
+		exceeds    bool
+	}{
+		{"at the limit", nested(3), false},
+		{"one over", nested(4), true},
+		{"objects count too", `{"a": {"b": {"c": {}}}}`, true},
+		{"siblings don't add up", `[[[1]], [[2]], {"a": [3]}]`, false},
+		{"brackets inside strings", `[["[[[[{{{{"]]`, false},
+		{"escaped quote stays in the string", `[["\"[[[["]]`, false},
+		{"escaped backslash ends the string", `[["\\", [[1]]]]`, true},
+		{"anything starting with a bracket is checked", strings.Repeat("[", 10) + " not really JSON", true},
+		{"plain text", "hello " + nested(10), false},
+		{"leading whitespace", " \n\t" + nested(4), true},
+	}
+	for _, tt := range tests {
+		if got := jsonDepthExceeds([]byte(tt.body), 3); got != tt.exceeds {
+			t.Errorf("%s: jsonDepthExceeds(%s, 3) = %v, want %v", tt.name, tt.body, got, tt.exceeds)
+		}
+	}
+}
+
+// A body split across writes, as /stream feeds it, gets the same answer.
+func TestDepthScannerAcrossWrites(t *testing.T) {
+	body := `[["\"[[[[", [["x"]]]]`
+	for split := 1; split < len(body); split++ {
+		d := &depthScanner{max: 3}
+		_, err1 := d.Write([]byte(body[:split]))
+		_, err2 := d.Write([]byte(body[split:]))
+		if err := errors.Join(err1, err2); !errors.Is(err, errJSONTooDeep) {
+			t.Fatalf("split at %d: error %v, want %v", split, err, errJSONTooDeep)
+		}
+	}
+}
+
+func TestCheckJSONDepthDefault(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.checkJSONDepth([]byte(nested(DEFAULT_MAX_JSON_DEPTH))); err != nil {
+		t.Fatalf("depth %d: %v", DEFAULT_MAX_JSON_DEPTH, err)
+	}
+	if err := cfg.checkJSONDepth([]byte(nested(DEFAULT_MAX_JSON_DEPTH + 1))); !errors.Is(err, errJSONTooDeep) {
+		t.Fatalf("depth %d: error %v, want %v", DEFAULT_MAX_JSON_DEPTH+1, err, errJSONTooDeep)
+	}
+}
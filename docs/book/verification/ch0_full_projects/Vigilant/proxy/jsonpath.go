@@ -0,0 +1,128 @@
+// Vigilant/proxy/jsonpath.go
+// MINIMAL JSONPATH: $.a.b[0]['c d'] for picking the scannable field
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ON_MISSING_ERROR     = "error"
+	ON_MISSING_SCAN_BODY = "scan_body"
+)
+
+// errScanFieldMissing means the configured scan field is absent and the
+// config says not to fall back to the whole body.
+var errScanFieldMissing = errors.New("SCAN_FIELD_MISSING")
+
+type ScanFieldConfig struct {
+	Path      string `json:"path"`
+	OnMissing string `json:"on_missing"`
+
+	compiled jsonPath
+}
+
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// jsonPath supports the root ($), dotted member names, quoted members
+// (['name'] or ["name"]) and array indices ([0]). Wildcards, slices and
+// filters are deliberately unsupported.
+type jsonPath []pathStep
+
+func compileJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("must start with $")
+	}
+	var path jsonPath
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty member name in %q", expr)
+			}
+			path = append(path, pathStep{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, pathStep{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			n, err := strconv.Atoi(inner)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad index [%s] in %q", inner, expr)
+			}
+			path = append(path, pathStep{index: n, isIndex: true})
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", rest[0], expr)
+		}
+	}
+	return path, nil
+}
+
+func (p jsonPath) Lookup(v any) (any, bool) {
+	for _, step := range p {
+		if step.isIndex {
+			arr, ok := v.([]any)
+			if !ok || step.index >= len(arr) {
+				return nil, false
+			}
+			v = arr[step.index]
+			continue
+		}
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[step.key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// scanContent returns the part of body the daemons should see. Without a
+// configured scan field that is the whole body. A string field is scanned as
+// its text; any other value as its JSON encoding.
+func (c *Config) scanContent(body []byte) ([]byte, error) {
+	sf := c.ScanField
+	if sf.compiled == nil {
+		return body, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err == nil {
+		if v, ok := sf.compiled.Lookup(doc); ok {
+			if s, isString := v.(string); isString {
+				return []byte(s), nil
+			}
+			return json.Marshal(v)
+		}
+	}
+	if sf.OnMissing == ON_MISSING_SCAN_BODY {
+		return body, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errScanFieldMissing, sf.Path)
+}
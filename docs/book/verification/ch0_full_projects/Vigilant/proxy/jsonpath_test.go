@@ -0,0 +1,69 @@
+// Vigilant/proxy/jsonpath_test.go
+// MINIMAL JSONPATH: selection, missing paths and rejected expressions
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func scanFieldConfig(t *testing.T, path, onMissing string) *Config {
+	t.Helper()
+	compiled, err := compileJSONPath(path)
+	if err != nil {
+		t.Fatalf("compileJSONPath(%q): %v", path, err)
+	}
+	return &Config{ScanField: ScanFieldConfig{Path: path, OnMissing: onMissing, compiled: compiled}}
+}
+
+func TestScanFieldSelects(t *testing.T) {
+	body := []byte(`{"data": {"text": "ssn 078-05-1120", "n": 7}, "items": [{"v": "first"}, {"v": "second"}], "odd key": true}`)
+	tests := []struct {
+		path, want string
+	}{
+		{"$", string(body)}, // the root is the body itself, as-is
+		{"$.data.text", "ssn 078-05-1120"},
+		{"$.data", `{"n":7,"text":"ssn 078-05-1120"}`},
+		{"$.data.n", "7"},
+		{"$.items[1].v", "second"},
+		{"$.items[0]", `{"v":"first"}`},
+		{"$['odd key']", "true"},
+		{`$["data"]["text"]`, "ssn 078-05-1120"},
+	}
+	for _, tt := range tests {
+		got, err := scanFieldConfig(t, tt.path, ON_MISSING_ERROR).scanContent(body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestScanFieldMissing(t *testing.T) {
+	body := []byte(`{"data": {"text": "x"}, "items": ["a"]}`)
+	for _, path := range []string{"$.nope", "$.data.text.deeper", "$.items[1]", "$.data[0]", "$.items.a"} {
+		if _, err := scanFieldConfig(t, path, ON_MISSING_ERROR).scanContent(body); !errors.Is(err, errScanFieldMissing) {
+			t.Errorf("%s: error %v, want %v", path, err, errScanFieldMissing)
+		}
+		got, err := scanFieldConfig(t, path, ON_MISSING_SCAN_BODY).scanContent(body)
+		if err != nil || string(got) != string(body) {
+			t.Errorf("%s with on_missing scan_body = %q, %v; want the whole body", path, got, err)
+		}
+	}
+	// A body that isn't JSON has no field to find.
+	if _, err := scanFieldConfig(t, "$.data", ON_MISSING_ERROR).scanContent([]byte("plain text")); !errors.Is(err, errScanFieldMissing) {
+		t.Errorf("non-JSON body: error %v, want %v", err, errScanFieldMissing)
+	}
+}
+
+func TestCompileJSONPathRejects(t *testing.T) {
+	for _, path := range []string{"", "data.text", "$.", "$..a", "$.a[", "$.a[-1]", "$.a[x]", "$.a[*]", "$a"} {
+		if _, err := compileJSONPath(path); err == nil {
+			t.Errorf("compileJSONPath(%q) succeeded, want an error", path)
+		}
+	}
+}
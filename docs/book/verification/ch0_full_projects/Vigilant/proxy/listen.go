@@ -0,0 +1,94 @@
+// Vigilant/proxy/listen.go
+// LISTEN ADDRESS RESOLUTION (multi-homed hosts)
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	DEFAULT_LISTEN = ":8091"
+	LISTEN_ENV     = "VIGILANT_LISTEN"
+)
+
+// parseListenAddrs turns a comma-separated list of host:port entries into
+// concrete addresses to bind. The host may be empty (all interfaces), an IP
+// literal, "localhost", or a network interface name such as wlan0, which
+// expands to every address assigned to that interface.
+func parseListenAddrs(spec string) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("LISTEN_ADDR_INVALID: %q: %v (want host:port, e.g. 127.0.0.1:8091 or wlan0:8091)", entry, err)
+		}
+		if p, err := net.LookupPort("tcp", port); err != nil || p == 0 {
+			return nil, fmt.Errorf("LISTEN_ADDR_INVALID: %q: bad port %q", entry, port)
+		}
+
+		hosts, err := resolveListenHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("LISTEN_ADDR_INVALID: %q: %v", entry, err)
+		}
+		for _, h := range hosts {
+			addr := net.JoinHostPort(h, port)
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("LISTEN_ADDR_INVALID: no addresses in %q", spec)
+	}
+	return addrs, nil
+}
+
+func resolveListenHost(host string) ([]string, error) {
+	if host == "" || host == "localhost" || net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor a network interface", host)
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", host, err)
+	}
+	var hosts []string
+	for _, a := range ifAddrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", host)
+	}
+	return hosts, nil
+}
+
+// listenAll binds every address up front so a bad entry fails startup before
+// any listener starts serving.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, fmt.Errorf("LISTEN_FAIL: %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,200 @@
+// Vigilant/proxy/metrics.go
+// METRICS: Prometheus text exposition of request, verdict and daemon stats
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LATENCY_BUCKETS are the histogram bounds in seconds, from a warm pooled
+// call up to the client timeouts.
+var LATENCY_BUCKETS = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The process vendors no client library, so the few metric kinds needed are
+// kept here and written in the text format every Prometheus scraper reads.
+// A series is keyed by its rendered label set, e.g. `route="/",code="200"`.
+
+type counterVec struct {
+	mu     sync.Mutex
+	series map[string]uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{series: make(map[string]uint64)}
+}
+
+func (c *counterVec) Inc(labels string) {
+	c.mu.Lock()
+	c.series[labels]++
+	c.mu.Unlock()
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec() *histogramVec {
+	return &histogramVec{series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(labels string, d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labels]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(LATENCY_BUCKETS))}
+		h.series[labels] = s
+	}
+	for i, le := range LATENCY_BUCKETS {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs renders k1, v1, k2, v2... as a label set.
+func labelPairs(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	return b.String()
+}
+
+type gatewayMetrics struct {
+	requests      *counterVec
+	blocked       *counterVec
+	redacted      *counterVec
+	daemonErrors  *counterVec
+	simulated     *counterVec
+	daemonLatency *histogramVec
+	handlerTime   *histogramVec
+}
+
+var metrics = &gatewayMetrics{
+	requests:      newCounterVec(),
+	blocked:       newCounterVec(),
+	redacted:      newCounterVec(),
+	daemonErrors:  newCounterVec(),
+	simulated:     newCounterVec(),
+	daemonLatency: newHistogramVec(),
+	handlerTime:   newHistogramVec(),
+}
+
+// countVerdict counts one scanned document's outcome on route. Simulated
+// verdicts are counted apart, so they never show up as enforced blocks.
+func (m *gatewayMetrics) countVerdict(route string, res ScanResult) {
+	if res.Simulated {
+		m.simulated.Inc(labelPairs("route", route, "verdict", res.Verdict))
+		return
+	}
+	switch res.Verdict {
+	case VERDICT_BLOCK:
+		m.blocked.Inc(labelPairs("route", route))
+	case VERDICT_REDACT:
+		m.redacted.Inc(labelPairs("route", route))
+	}
+}
+
+// observeDaemon records one daemon call, dial to last response byte.
+func (m *gatewayMetrics) observeDaemon(sock string, start time.Time, err error) {
+	labels := labelPairs("socket", sock)
+	m.daemonLatency.Observe(labels, time.Since(start))
+	if err != nil {
+		m.daemonErrors.Inc(labels)
+	}
+}
+
+// withMetrics counts requests and their handler latency under route. The
+// route, not the request path, is the label: "/" serves every path and would
+// otherwise grow a series per URL.
+func withMetrics(route string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			metrics.requests.Inc(labelPairs("route", route, "code", strconv.Itoa(rec.status)))
+			metrics.handlerTime.Observe(labelPairs("route", route), time.Since(start))
+		})
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, labels := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, c.series[labels])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogramVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, labels := range sortedKeys(h.series) {
+		s := h.series[labels]
+		for i, le := range LATENCY_BUCKETS {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsHandler serves GET /metrics. The thresholds are read from the live
+// config, so a reload shows up on the next scrape.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeCounter(w, "vigilant_requests_total", "Requests served, by route and status code.", metrics.requests)
+	writeCounter(w, "vigilant_blocked_total", "Documents blocked, by route.", metrics.blocked)
+	writeCounter(w, "vigilant_redacted_total", "Documents returned redacted, by route.", metrics.redacted)
+	writeCounter(w, "vigilant_simulated_total", "Verdicts reported but not enforced in simulate mode, by route and verdict.", metrics.simulated)
+	writeCounter(w, "vigilant_daemon_errors_total", "Failed daemon calls, by socket.", metrics.daemonErrors)
+	writeHistogram(w, "vigilant_daemon_scan_seconds", "Daemon call latency from dial to response, by socket.", metrics.daemonLatency)
+	writeHistogram(w, "vigilant_request_duration_seconds", "Handler latency, by route.", metrics.handlerTime)
+	writeGauge(w, "vigilant_block_threshold", "Score at or above which a document is blocked.", cfg.Thresholds.Block)
+	writeGauge(w, "vigilant_redact_threshold", "Score at or above which a document is redacted.", cfg.Thresholds.Redact)
+}
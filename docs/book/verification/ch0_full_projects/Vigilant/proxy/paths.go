@@ -0,0 +1,84 @@
+// Vigilant/proxy/paths.go
+// RUNTIME PATHS: daemon sockets, PKI and policy files, overridable from the environment
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+const (
+	SHIELD_SOCK_ENV  = "VIGILANT_SHIELD_SOCK"
+	ANALYST_SOCK_ENV = "VIGILANT_ANALYST_SOCK"
+	CA_CERT_ENV      = "VIGILANT_CA_CERT"
+	SERVER_CERT_ENV  = "VIGILANT_SERVER_CERT"
+	SERVER_KEY_ENV   = "VIGILANT_SERVER_KEY"
+	CLIENT_CERT_ENV  = "VIGILANT_CLIENT_CERT"
+	CLIENT_KEY_ENV   = "VIGILANT_CLIENT_KEY"
+	POLICY_FILE_ENV  = "VIGILANT_POLICY_FILE"
+
+	// AUTH_KEY_ENV supplies the auth key when there is no secrets directory.
+	AUTH_KEY_ENV = "VIGILANT_AUTH_KEY"
+
+	// With MODE_ENV=production the gateway refuses every dev fallback.
+	MODE_ENV        = "VIGILANT_MODE"
+	MODE_PRODUCTION = "production"
+)
+
+// runtimePaths are the file and socket locations in use. The compiled
+// constants are development defaults only.
+type runtimePaths struct {
+	ShieldSock  string
+	AnalystSock string
+	CACert      string
+	ServerCert  string
+	ServerKey   string
+	ClientCert  string
+	ClientKey   string
+
+	// Policy is the default policy source for the gateway and every
+	// subcommand: VIGILANT_POLICY_DIR, else VIGILANT_POLICY_FILE.
+	Policy string
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func pathsFromEnv() runtimePaths {
+	return runtimePaths{
+		ShieldSock:  envOr(SHIELD_SOCK_ENV, SHIELD_SOCK),
+		AnalystSock: envOr(ANALYST_SOCK_ENV, ANALYST_SOCK),
+		CACert:      envOr(CA_CERT_ENV, CA_CERT),
+		ServerCert:  envOr(SERVER_CERT_ENV, SERVER_CERT),
+		ServerKey:   envOr(SERVER_KEY_ENV, SERVER_KEY),
+		ClientCert:  envOr(CLIENT_CERT_ENV, CLIENT_CERT),
+		ClientKey:   envOr(CLIENT_KEY_ENV, CLIENT_KEY),
+		Policy:      envOr(POLICY_DIR_ENV, envOr(POLICY_FILE_ENV, POLICY_FILE)),
+	}
+}
+
+var paths = pathsFromEnv()
+
+func productionMode() bool {
+	return os.Getenv(MODE_ENV) == MODE_PRODUCTION
+}
+
+// requireProductionSafe stops startup in production mode when the gateway
+// would fall back to the compiled debug key or run without mTLS.
+func requireProductionSafe(insecureDev bool) {
+	if !productionMode() {
+		return
+	}
+	if insecureDev {
+		log.Fatalf("PRODUCTION_UNSAFE: --insecure-dev is not allowed with %s=%s", MODE_ENV, MODE_PRODUCTION)
+	}
+	if os.Getenv(SECRETS_DIR_ENV) == "" && os.Getenv(AUTH_KEY_ENV) == "" {
+		log.Fatalf("PRODUCTION_UNSAFE: set %s or %s; the compiled debug auth key is refused with %s=%s",
+			SECRETS_DIR_ENV, AUTH_KEY_ENV, MODE_ENV, MODE_PRODUCTION)
+	}
+}
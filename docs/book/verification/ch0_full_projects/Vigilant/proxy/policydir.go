@@ -0,0 +1,141 @@
+// Vigilant/proxy/policydir.go
+// POLICY DIRECTORY: one risk matrix assembled from per-team files
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	POLICY_DIR_ENV   = "VIGILANT_POLICY_DIR"
+	POLICY_BASE_FILE = "base.json"
+)
+
+// loadPolicyDir merges every *.json file in dir into one Config. base.json
+// owns thresholds and all other settings and may also carry policies; every
+// other file may only contribute a "policies" list. A policy type defined
+// in more than one place is an error naming both files.
+func loadPolicyDir(dir string) (Config, []ConfigProblem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	var cfg Config
+	var problems []ConfigProblem
+	var files []string
+	haveBase := false
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		if name == POLICY_BASE_FILE {
+			haveBase = true
+			continue
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	if !haveBase {
+		return cfg, []ConfigProblem{{File: POLICY_BASE_FILE, Message: "missing: a policy directory needs a base file with thresholds"}}, nil
+	}
+
+	// The base file is decoded like a standalone config; its policy list
+	// merges with the others.
+	data, err := readVerified(filepath.Join(dir, POLICY_BASE_FILE))
+	if err != nil {
+		return Config{}, nil, err
+	}
+	if p := decodeJSON(data, &cfg); p != nil {
+		p.File = POLICY_BASE_FILE
+		return cfg, []ConfigProblem{*p}, nil
+	}
+	for _, p := range cfg.validateSettings() {
+		p.File = POLICY_BASE_FILE
+		problems = append(problems, p)
+	}
+
+	owner := make(map[string]string)
+	merged := make([]Policy, 0, len(cfg.Policies))
+	mergeFrom := func(file string, policies []Policy) {
+		for _, p := range validatePolicies(policies) {
+			p.File = file
+			problems = append(problems, p)
+		}
+		for i, p := range policies {
+			if p.composite() {
+				merged = append(merged, p)
+				continue
+			}
+			if p.Type == "" {
+				continue
+			}
+			if prev, dup := owner[p.Type]; dup {
+				if prev == file {
+					continue // validatePolicies reported it
+				}
+				problems = append(problems, ConfigProblem{
+					File:    file,
+					Field:   fmt.Sprintf("policies[%d].type", i),
+					Message: fmt.Sprintf("duplicate type %q (also defined in %s)", p.Type, prev),
+				})
+				continue
+			}
+			owner[p.Type] = file
+			merged = append(merged, p)
+		}
+	}
+	mergeFrom(POLICY_BASE_FILE, cfg.Policies)
+
+	for _, name := range files {
+		data, err := readVerified(filepath.Join(dir, name))
+		if err != nil {
+			return Config{}, nil, err
+		}
+		var keys map[string]json.RawMessage
+		if p := decodeJSON(data, &keys); p != nil {
+			p.File = name
+			problems = append(problems, *p)
+			continue
+		}
+		extra := false
+		names := make([]string, 0, len(keys))
+		for key := range keys {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		for _, key := range names {
+			if key != "policies" {
+				problems = append(problems, ConfigProblem{File: name, Field: key, Message: "only \"policies\" may be set outside " + POLICY_BASE_FILE})
+				extra = true
+			}
+		}
+		if extra {
+			continue
+		}
+		var part struct {
+			Policies []Policy `json:"policies"`
+		}
+		if p := decodeJSON(data, &part); p != nil {
+			p.File = name
+			problems = append(problems, *p)
+			continue
+		}
+		mergeFrom(name, part.Policies)
+	}
+
+	cfg.Policies = merged
+	problems = append(problems, requirePolicies(merged)...)
+	for _, p := range cfg.checkPolicySetsStricter() {
+		p.File = POLICY_BASE_FILE
+		problems = append(problems, p)
+	}
+	return cfg, problems, nil
+}
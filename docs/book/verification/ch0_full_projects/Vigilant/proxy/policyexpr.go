@@ -0,0 +1,354 @@
+// Vigilant/proxy/policyexpr.go
+// VERDICT EXPRESSIONS: boolean rules over the findings of one request
+//
+// Grammar (precedence low to high):
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = primary [ ("==" | "!=" | "<" | "<=" | ">" | ">=") primary ]
+//	primary = INT | "true" | "false" | "score" | "findings"
+//	        | "count" "(" STRING ")" | "has" "(" STRING ")" | "(" expr ")"
+//
+// score is the summed policy score, findings the number of findings,
+// count(t) the number of findings of type t and has(t) is count(t) > 0.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprEnv is what an expression can see about one request.
+type exprEnv struct {
+	score  int
+	total  int
+	counts map[string]int
+}
+
+func newExprEnv(findings []Finding, score int) *exprEnv {
+	env := &exprEnv{score: score, total: len(findings), counts: make(map[string]int)}
+	for _, f := range findings {
+		env.counts[f.Type]++
+	}
+	return env
+}
+
+// verdictExpr is a compiled expression; it is type-checked at compile time,
+// so evaluation cannot fail.
+type verdictExpr struct {
+	src  string
+	eval func(*exprEnv) bool
+}
+
+func (e *verdictExpr) Blocks(findings []Finding, score int) bool {
+	return e.eval(newExprEnv(findings, score))
+}
+
+type exprType int
+
+const (
+	EXPR_INT exprType = iota
+	EXPR_BOOL
+)
+
+func (t exprType) String() string {
+	if t == EXPR_BOOL {
+		return "bool"
+	}
+	return "int"
+}
+
+// exprNode is a typed, compiled subexpression. Exactly one of i or b is set,
+// matching typ.
+type exprNode struct {
+	typ exprType
+	i   func(*exprEnv) int
+	b   func(*exprEnv) bool
+}
+
+type exprToken struct {
+	kind string // "int", "str", "ident", "op", "eof"
+	text string
+	pos  int
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(src) && unicode.IsDigit(rune(src[j])) {
+				j++
+			}
+			toks = append(toks, exprToken{"int", src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, exprToken{"ident", src[i:j], i})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("offset %d: unterminated string", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("offset %d: bad string %s", i, src[i:j+1])
+			}
+			toks = append(toks, exprToken{"str", s, i})
+			i = j + 1
+		default:
+			op := ""
+			for _, cand := range []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(src[i:], cand) {
+					op = cand
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("offset %d: unexpected %q", i, c)
+			}
+			toks = append(toks, exprToken{"op", op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{"eof", "", len(src)}), nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == "op" && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("offset %d: expected %q, got %s", t.pos, op, describeToken(t))
+	}
+	return nil
+}
+
+func describeToken(t exprToken) string {
+	if t.kind == "eof" {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func requireType(n exprNode, want exprType, pos int, what string) error {
+	if n.typ != want {
+		return fmt.Errorf("offset %d: %s needs %s, got %s", pos, what, want, n.typ)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for {
+		pos := p.peek().pos
+		if !p.accept("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if err := requireType(left, EXPR_BOOL, pos, "||"); err != nil {
+			return exprNode{}, err
+		}
+		if err := requireType(right, EXPR_BOOL, pos, "||"); err != nil {
+			return exprNode{}, err
+		}
+		l, r := left.b, right.b
+		left = exprNode{typ: EXPR_BOOL, b: func(e *exprEnv) bool { return l(e) || r(e) }}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for {
+		pos := p.peek().pos
+		if !p.accept("&&") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if err := requireType(left, EXPR_BOOL, pos, "&&"); err != nil {
+			return exprNode{}, err
+		}
+		if err := requireType(right, EXPR_BOOL, pos, "&&"); err != nil {
+			return exprNode{}, err
+		}
+		l, r := left.b, right.b
+		left = exprNode{typ: EXPR_BOOL, b: func(e *exprEnv) bool { return l(e) && r(e) }}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	pos := p.peek().pos
+	if p.accept("!") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if err := requireType(n, EXPR_BOOL, pos, "!"); err != nil {
+			return exprNode{}, err
+		}
+		inner := n.b
+		return exprNode{typ: EXPR_BOOL, b: func(e *exprEnv) bool { return !inner(e) }}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	t := p.peek()
+	var cmp func(a, b int) bool
+	switch t.text {
+	case "==":
+		cmp = func(a, b int) bool { return a == b }
+	case "!=":
+		cmp = func(a, b int) bool { return a != b }
+	case "<":
+		cmp = func(a, b int) bool { return a < b }
+	case "<=":
+		cmp = func(a, b int) bool { return a <= b }
+	case ">":
+		cmp = func(a, b int) bool { return a > b }
+	case ">=":
+		cmp = func(a, b int) bool { return a >= b }
+	}
+	if t.kind != "op" || cmp == nil {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parsePrimary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if err := requireType(left, EXPR_INT, t.pos, t.text); err != nil {
+		return exprNode{}, err
+	}
+	if err := requireType(right, EXPR_INT, t.pos, t.text); err != nil {
+		return exprNode{}, err
+	}
+	l, r := left.i, right.i
+	return exprNode{typ: EXPR_BOOL, b: func(e *exprEnv) bool { return cmp(l(e), r(e)) }}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "int":
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return exprNode{}, fmt.Errorf("offset %d: integer %s out of range", t.pos, t.text)
+		}
+		return exprNode{typ: EXPR_INT, i: func(*exprEnv) int { return n }}, nil
+	case "ident":
+		switch t.text {
+		case "true", "false":
+			v := t.text == "true"
+			return exprNode{typ: EXPR_BOOL, b: func(*exprEnv) bool { return v }}, nil
+		case "score":
+			return exprNode{typ: EXPR_INT, i: func(e *exprEnv) int { return e.score }}, nil
+		case "findings":
+			return exprNode{typ: EXPR_INT, i: func(e *exprEnv) int { return e.total }}, nil
+		case "count", "has":
+			if err := p.expect("("); err != nil {
+				return exprNode{}, err
+			}
+			arg := p.next()
+			if arg.kind != "str" {
+				return exprNode{}, fmt.Errorf("offset %d: %s() takes a finding type string, got %s", arg.pos, t.text, describeToken(arg))
+			}
+			if err := p.expect(")"); err != nil {
+				return exprNode{}, err
+			}
+			typ := arg.text
+			if t.text == "has" {
+				return exprNode{typ: EXPR_BOOL, b: func(e *exprEnv) bool { return e.counts[typ] > 0 }}, nil
+			}
+			return exprNode{typ: EXPR_INT, i: func(e *exprEnv) int { return e.counts[typ] }}, nil
+		}
+		return exprNode{}, fmt.Errorf("offset %d: unknown name %q (want score, findings, count, has, true, false)", t.pos, t.text)
+	case "op":
+		if t.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return exprNode{}, err
+			}
+			if err := p.expect(")"); err != nil {
+				return exprNode{}, err
+			}
+			return n, nil
+		}
+	}
+	return exprNode{}, fmt.Errorf("offset %d: unexpected %s", t.pos, describeToken(t))
+}
+
+// compileVerdictExpr parses and type-checks src. The result must be boolean.
+func compileVerdictExpr(src string) (*verdictExpr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("offset %d: unexpected %s", t.pos, describeToken(t))
+	}
+	if n.typ != EXPR_BOOL {
+		return nil, fmt.Errorf("expression is %s, must be bool (e.g. score > 40)", n.typ)
+	}
+	return &verdictExpr{src: src, eval: n.b}, nil
+}
@@ -0,0 +1,82 @@
+// Vigilant/proxy/policyexpr_test.go
+// VERDICT EXPRESSIONS: precedence, finding counts and compile-time rejection
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerdictExprEval(t *testing.T) {
+	findings := []Finding{{Type: "ID_SSN"}, {Type: "ID_EMAIL"}, {Type: "ID_EMAIL"}}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		// && binds tighter than ||, ! tighter than both.
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"false || !true || score >= 50", true},
+		// Comparisons bind tighter than && and !.
+		{"score > 40 && findings == 3", true},
+		{"!score > 40", false},
+		{"score >= 50 && score <= 50 && score != 49 && score < 51", true},
+		// count and has over the findings.
+		{"count(\"ID_EMAIL\") == 2", true},
+		{"has(\"ID_SSN\") && count(\"ID_SSN\") == 1", true},
+		// Unknown types count as zero, never fail.
+		{"count(\"NO_SUCH_TYPE\") == 0", true},
+		{"has(\"NO_SUCH_TYPE\")", false},
+		{"!has(\"NO_SUCH_TYPE\") && count(\"\") == 0", true},
+	}
+	for _, tt := range tests {
+		expr, err := compileVerdictExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got := expr.Blocks(findings, 50); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestVerdictExprRejected(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		// Type errors are caught at compile time.
+		{"score", "must be bool"},
+		{"score && true", "&& needs bool, got int"},
+		{"true || 1", "|| needs bool, got int"},
+		{"!score", "! needs bool, got int"},
+		{"has(\"ID_SSN\") > 1", "> needs int, got bool"},
+		{"count(ID_SSN) > 0", "takes a finding type string"},
+		// Trailing tokens.
+		{"score > 40 true", "offset 11: unexpected \"true\""},
+		{"score > 40 > 3", "unexpected \">\""},
+		// Unbalanced parentheses.
+		{"(score > 40", "expected \")\", got end of expression"},
+		{"score > 40)", "offset 10: unexpected \")\""},
+		{"has(\"ID_SSN\"", "expected \")\""},
+		{"()", "unexpected \")\""},
+		// Lexing.
+		{"score > 40 & true", "unexpected '&'"},
+		{"has(\"ID_SSN)", "unterminated string"},
+		{"nope > 1", "unknown name \"nope\""},
+		{"", "unexpected end of expression"},
+	}
+	for _, tt := range tests {
+		_, err := compileVerdictExpr(tt.src)
+		if err == nil {
+			t.Errorf("%s: compiled, want error containing %q", tt.src, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q, want it to contain %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Vigilant/proxy/policyset.go
+// POLICY OVERRIDES: named policy sets selected by a signed request header
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	POLICY_HEADER           = "X-Vigilant-Policy"
+	POLICY_TIMESTAMP_HEADER = "X-Vigilant-Policy-Timestamp"
+	POLICY_NONCE_HEADER     = "X-Vigilant-Policy-Nonce"
+	POLICY_SIGNATURE_HEADER = "X-Vigilant-Policy-Signature"
+
+	// POLICY_SIGNATURE_CONTEXT prefixes every signed override, so a
+	// signature made for anything else never verifies as one.
+	POLICY_SIGNATURE_CONTEXT = "vigilant-policy-override-v1"
+	POLICY_OVERRIDE_MAX_AGE  = 5 * time.Minute
+	POLICY_NONCE_MAX_LEN     = 64
+)
+
+// PolicySet is a named variant of the base policy. Unset fields inherit from
+// the base config; listed policies replace the base score for their type.
+// A set may only be stricter than the base unless AllowLoosening is set.
+type PolicySet struct {
+	Policies       []Policy `json:"policies"`
+	Block          int      `json:"block"`
+	VerdictExpr    string   `json:"verdict_expr"`
+	AllowLoosening bool     `json:"allow_loosening"`
+}
+
+// scoringRules is everything scanDocument needs to turn findings into a
+// verdict. Overrides are kept apart from the base policy list, which a policy
+// directory only finishes merging after the settings are validated.
+type scoringRules struct {
+	cfg       *Config
+	name      string
+	overrides map[string]int
+	block     int
+	verdict   *verdictExpr
+}
+
+// score sums the findings. A type overridden by the request's policy set
+// wins, then a severity listed in severity_scores, then the policy table.
+// Composite policies are added last, once each.
+func (s *scoringRules) score(findings []Finding) int {
+	total := 0
+	for _, f := range findings {
+		if v, ok := s.overrides[f.Type]; ok {
+			total += s.cfg.Confidence.weight(f, v)
+			continue
+		}
+		if v, ok := s.cfg.SeverityScores[strings.ToLower(f.Severity)]; ok && f.Severity != "" {
+			total += s.cfg.Confidence.weight(f, v)
+			continue
+		}
+		for _, p := range s.cfg.Policies {
+			if !p.composite() && f.Type == p.Type {
+				total += s.cfg.Confidence.weight(f, p.Score)
+			}
+		}
+	}
+	return total + s.cfg.compositeScore(findings)
+}
+
+func (s *scoringRules) blocks(findings []Finding, score int) bool {
+	if s.verdict != nil {
+		return s.verdict.Blocks(findings, score)
+	}
+	return score >= s.block
+}
+
+func (c *Config) baseRules() *scoringRules {
+	return &scoringRules{cfg: c, name: "default", block: c.Thresholds.Block, verdict: c.verdict}
+}
+
+// compilePolicySets validates policy_sets and trusted_override_keys and
+// resolves each set against the base policy. Called from validateSettings.
+func (c *Config) compilePolicySets() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	c.overrideKeys = nil
+	for i, k := range c.TrustedOverrideKeys {
+		key, err := parsePublicKey(k)
+		if err != nil {
+			add(fmt.Sprintf("trusted_override_keys[%d]", i), "%v", err)
+			continue
+		}
+		c.overrideKeys = append(c.overrideKeys, key)
+	}
+	if len(c.PolicySets) > 0 && len(c.TrustedOverrideKeys) == 0 {
+		add("trusted_override_keys", "must list at least one key when policy_sets is set (overrides can never be honored)")
+	}
+
+	c.policySets = make(map[string]*scoringRules)
+	for name, set := range c.PolicySets {
+		field := "policy_sets." + name
+		if name == "" || strings.ContainsAny(name, " \t\r\n,") {
+			add(field, "name must be non-empty without whitespace or commas")
+			continue
+		}
+		for _, p := range validatePolicies(set.Policies) {
+			p.Field = field + "." + p.Field
+			problems = append(problems, p)
+		}
+		for i, p := range set.Policies {
+			if p.composite() {
+				add(fmt.Sprintf("%s.policies[%d]", field, i), "composite policies belong in the base policies list; a set only overrides type scores")
+			}
+		}
+		if set.Block < 0 {
+			add(field+".block", "must be >= 0, got %d", set.Block)
+		} else if set.Block > 0 && set.Block <= c.Thresholds.Redact {
+			add(field+".block", "must be > thresholds.redact (%d), got %d", c.Thresholds.Redact, set.Block)
+		}
+
+		rules := c.baseRules()
+		rules.name = name
+		rules.overrides = make(map[string]int)
+		for _, p := range set.Policies {
+			rules.overrides[p.Type] = p.Score
+		}
+		if set.Block > 0 {
+			rules.block = set.Block
+		}
+		if set.VerdictExpr != "" {
+			expr, err := compileVerdictExpr(set.VerdictExpr)
+			if err != nil {
+				add(field+".verdict_expr", "%v", err)
+				continue
+			}
+			rules.verdict = expr
+		}
+		c.policySets[name] = rules
+	}
+	return problems
+}
+
+// checkPolicySetsStricter rejects sets that could let through what the base
+// policy blocks: a higher block threshold, a type scored below its base
+// score or below any severity_scores value (a set's score wins over the
+// finding's severity), or a verdict_expr, which can't be compared. It needs
+// the final base policy list, so it runs after a policy directory has
+// merged its files.
+func (c *Config) checkPolicySetsStricter() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	base := make(map[string]int)
+	for _, p := range c.Policies {
+		if !p.composite() {
+			base[p.Type] = p.Score
+		}
+	}
+	severity := 0
+	for _, v := range c.SeverityScores {
+		severity = max(severity, v)
+	}
+	hint := "(set allow_loosening to permit it)"
+	for name, set := range c.PolicySets {
+		if set.AllowLoosening {
+			continue
+		}
+		field := "policy_sets." + name
+		if set.Block > c.Thresholds.Block {
+			add(field+".block", "%d is looser than thresholds.block (%d) %s", set.Block, c.Thresholds.Block, hint)
+		}
+		for i, p := range set.Policies {
+			if p.Score < base[p.Type] {
+				add(fmt.Sprintf("%s.policies[%d].score", field, i), "%d for %q is below its base score %d %s", p.Score, p.Type, base[p.Type], hint)
+			} else if p.Score < severity {
+				add(fmt.Sprintf("%s.policies[%d].score", field, i), "%d for %q is below severity_scores %d, which it would override %s", p.Score, p.Type, severity, hint)
+			}
+		}
+		if set.VerdictExpr != "" {
+			add(field+".verdict_expr", "may be looser than the base verdict %s", hint)
+		}
+	}
+	return problems
+}
+
+// decodeKeyText decodes a raw key given as hex or (standard or URL-safe)
+// base64.
+func decodeKeyText(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if raw, err := hex.DecodeString(text); err == nil {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(text); err == nil {
+		return raw, nil
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "=")); err == nil {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("key is neither hex nor base64")
+}
+
+// parsePublicKey accepts a 32-byte ed25519 public key as hex or base64.
+func parsePublicKey(text string) (ed25519.PublicKey, error) {
+	raw, err := decodeKeyText(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("want a %d-byte ed25519 public key, got %d bytes", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// overrideClaim is a request's X-Vigilant-Policy headers, parsed but not yet
+// verified: the signature covers the body, which the handler reads later.
+type overrideClaim struct {
+	name, nonce string
+	ts          int64
+	sig         []byte
+}
+
+// overrideMessage is what a trusted key signs, one field per line: the
+// context, the set name, the Unix timestamp, the nonce and the hex SHA-256
+// of the request body.
+func overrideMessage(name string, ts int64, nonce string, sum [sha256.Size]byte) []byte {
+	return fmt.Appendf(nil, "%s\n%s\n%d\n%s\n%x", POLICY_SIGNATURE_CONTEXT, name, ts, nonce, sum)
+}
+
+// parseOverrideClaim checks everything about the override headers that
+// doesn't need the body.
+func parseOverrideClaim(r *http.Request, cfg *Config, now time.Time) (*overrideClaim, error) {
+	c := &overrideClaim{name: r.Header.Get(POLICY_HEADER), nonce: r.Header.Get(POLICY_NONCE_HEADER)}
+	if _, ok := cfg.policySets[c.name]; !ok {
+		return nil, fmt.Errorf("unknown policy set %q", c.name)
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(POLICY_TIMESTAMP_HEADER), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("policy set %q: missing or bad %s", c.name, POLICY_TIMESTAMP_HEADER)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > POLICY_OVERRIDE_MAX_AGE || age < -POLICY_OVERRIDE_MAX_AGE {
+		return nil, fmt.Errorf("policy set %q: timestamp is %s off, outside %s", c.name, age.Round(time.Second), POLICY_OVERRIDE_MAX_AGE)
+	}
+	c.ts = ts
+	if c.nonce == "" || len(c.nonce) > POLICY_NONCE_MAX_LEN || strings.ContainsAny(c.nonce, " \t\r\n") {
+		return nil, fmt.Errorf("policy set %q: missing or bad %s", c.name, POLICY_NONCE_HEADER)
+	}
+	sig := r.Header.Get(POLICY_SIGNATURE_HEADER)
+	if c.sig, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(sig, "=")); err != nil || sig == "" {
+		return nil, fmt.Errorf("policy set %q: missing or invalid signature", c.name)
+	}
+	return c, nil
+}
+
+// verifyOverride reports whether the claim is signed, for a body with digest
+// sum, by any trusted key.
+func (c *Config) verifyOverride(claim *overrideClaim, sum [sha256.Size]byte) bool {
+	msg := overrideMessage(claim.name, claim.ts, claim.nonce, sum)
+	for _, key := range c.overrideKeys {
+		if ed25519.Verify(key, msg, claim.sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonceCache remembers each used nonce until its timestamp leaves the
+// freshness window, after which the header is refused as stale anyway.
+type nonceCache struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+var overrideNonces = &nonceCache{expires: make(map[string]time.Time)}
+
+// use marks nonce as used and reports whether it was fresh.
+func (n *nonceCache) use(nonce string, ts int64, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.lastSweep) > POLICY_OVERRIDE_MAX_AGE {
+		for k, exp := range n.expires {
+			if now.After(exp) {
+				delete(n.expires, k)
+			}
+		}
+		n.lastSweep = now
+	}
+	if exp, seen := n.expires[nonce]; seen && !now.After(exp) {
+		return false
+	}
+	n.expires[nonce] = time.Unix(ts, 0).Add(POLICY_OVERRIDE_MAX_AGE)
+	return true
+}
+
+type overrideClaimKey struct{}
+
+type policySetKey struct{}
+
+// rulesFrom returns the scoring rules of cfg for the request: the verified
+// policy set, or the base rules when no override applies. The set is looked
+// up by name so a config reload mid-request can't mix two configs.
+func rulesFrom(ctx context.Context, cfg *Config) *scoringRules {
+	if name, ok := ctx.Value(policySetKey{}).(string); ok {
+		if set, ok := cfg.policySets[name]; ok {
+			r := *set
+			r.cfg = cfg
+			return &r
+		}
+	}
+	return cfg.baseRules()
+}
+
+// rulesNamed returns the rules a scoringRules.name refers to in c, for
+// replaying a recorded verdict.
+func (c *Config) rulesNamed(name string) (*scoringRules, bool) {
+	if set, ok := c.policySets[name]; ok {
+		r := *set
+		r.cfg = c
+		return &r, true
+	}
+	base := c.baseRules()
+	return base, name == base.name
+}
+
+// withPolicyOverride parses X-Vigilant-Policy and its timestamp, nonce and
+// signature headers. The handler confirms the claim with confirmOverride
+// once it knows the body digest. Anything invalid is ignored with a warning,
+// so a client can never pick its own policy.
+func withPolicyOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(POLICY_HEADER) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claim, err := parseOverrideClaim(r, currentConfig(), time.Now())
+		if err != nil {
+			log.Printf("[POLICY_OVERRIDE_IGNORED] id=%s %v", w.Header().Get("X-Request-ID"), err)
+		} else {
+			r = r.WithContext(context.WithValue(r.Context(), overrideClaimKey{}, claim))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// confirmOverride applies the request's policy set claim when its signature
+// covers a body with digest sum and its nonce hasn't been used. A nonce is
+// only spent by a valid signature, so forged headers can't burn one.
+func confirmOverride(r *http.Request, sum [sha256.Size]byte) *http.Request {
+	claim, ok := r.Context().Value(overrideClaimKey{}).(*overrideClaim)
+	if !ok {
+		return r
+	}
+	id := requestIDFrom(r.Context())
+	switch {
+	case !currentConfig().verifyOverride(claim, sum):
+		log.Printf("[POLICY_OVERRIDE_IGNORED] id=%s policy set %q: signature does not cover this request", id, claim.name)
+	case !overrideNonces.use(claim.nonce, claim.ts, time.Now()):
+		log.Printf("[POLICY_OVERRIDE_IGNORED] id=%s policy set %q: nonce %q already used", id, claim.name, claim.nonce)
+	default:
+		log.Printf("[POLICY_OVERRIDE] id=%s policy set %q", id, claim.name)
+		return r.WithContext(context.WithValue(r.Context(), policySetKey{}, claim.name))
+	}
+	return r
+}
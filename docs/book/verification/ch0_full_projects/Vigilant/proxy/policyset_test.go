@@ -0,0 +1,112 @@
+// Vigilant/proxy/policyset_test.go
+// POLICY OVERRIDES: only a fresh, unreplayed signature over this body applies
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// overrideConfig installs a config with a "strict" set trusting key.
+func overrideConfig(t *testing.T, key ed25519.PublicKey) {
+	t.Helper()
+	cfg, problems := parseConfig([]byte(`{
+		"policies": [{"type": "ID_SSN", "score": 100}],
+		"thresholds": {"block": 90, "redact": 40},
+		"policy_sets": {"strict": {"block": 60}},
+		"trusted_override_keys": ["` + hex.EncodeToString(key) + `"]
+	}`))
+	if len(problems) > 0 {
+		t.Fatalf("config problems: %v", problems)
+	}
+	saved := currentConfig()
+	liveConfig.Store(&cfg)
+	t.Cleanup(func() { liveConfig.Store(saved) })
+}
+
+type override struct {
+	body, signedBody, nonce string
+	ts                      int64
+	key                     ed25519.PrivateKey
+}
+
+// policyApplied sends o through withPolicyOverride and confirmOverride and
+// returns the policy set the request ends up scored with.
+func policyApplied(o override) string {
+	sig := ed25519.Sign(o.key, overrideMessage("strict", o.ts, o.nonce, sha256.Sum256([]byte(o.signedBody))))
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(o.body))
+	r.Header.Set(POLICY_HEADER, "strict")
+	r.Header.Set(POLICY_TIMESTAMP_HEADER, strconv.FormatInt(o.ts, 10))
+	r.Header.Set(POLICY_NONCE_HEADER, o.nonce)
+	r.Header.Set(POLICY_SIGNATURE_HEADER, base64.RawURLEncoding.EncodeToString(sig))
+
+	var name string
+	withPolicyOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = confirmOverride(r, sha256.Sum256([]byte(o.body)))
+		name = rulesFrom(r.Context(), currentConfig()).name
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return name
+}
+
+func TestPolicyOverrideVerification(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	overrideConfig(t, pub)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name string
+		o    override
+		want string
+	}{
+		{"signed", override{body: "doc", signedBody: "doc", nonce: "n-signed", ts: now, key: priv}, "strict"},
+		{"tampered body", override{body: "doc!", signedBody: "doc", nonce: "n-tampered", ts: now, key: priv}, "default"},
+		{"stale timestamp", override{body: "doc", signedBody: "doc", nonce: "n-stale", ts: now - 600, key: priv}, "default"},
+		{"future timestamp", override{body: "doc", signedBody: "doc", nonce: "n-future", ts: now + 600, key: priv}, "default"},
+		{"wrong key", override{body: "doc", signedBody: "doc", nonce: "n-wrong-key", ts: now, key: other}, "default"},
+		{"replayed nonce", override{body: "doc", signedBody: "doc", nonce: "n-signed", ts: now, key: priv}, "default"},
+	}
+	for _, tt := range tests {
+		if got := policyApplied(tt.o); got != tt.want {
+			t.Errorf("%s: scored with %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForgedOverrideDoesNotSpendNonce(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	overrideConfig(t, pub)
+	o := override{body: "doc", signedBody: "doc", nonce: "n-forged-first", ts: time.Now().Unix(), key: other}
+
+	if got := policyApplied(o); got != "default" {
+		t.Fatalf("forged override scored with %q", got)
+	}
+	o.key = priv
+	if got := policyApplied(o); got != "strict" {
+		t.Fatalf("a forged request burned the nonce: genuine override scored with %q", got)
+	}
+}
+
+func TestPolicySetBelowSeverityScoreIsLooser(t *testing.T) {
+	_, problems := parseConfig([]byte(`{
+		"policies": [{"type": "ID_EMAIL", "score": 20}],
+		"thresholds": {"block": 90, "redact": 40},
+		"severity_scores": {"critical": 100},
+		"policy_sets": {"soft": {"policies": [{"type": "ID_EMAIL", "score": 30}]}},
+		"trusted_override_keys": ["` + strings.Repeat("ab", ed25519.PublicKeySize) + `"]
+	}`))
+	if len(problems) != 1 || problems[0].Field != "policy_sets.soft.policies[0].score" {
+		t.Fatalf("problems = %v, want one for the ID_EMAIL score below severity_scores.critical", problems)
+	}
+}
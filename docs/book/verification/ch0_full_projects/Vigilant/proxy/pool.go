@@ -0,0 +1,289 @@
+// Vigilant/proxy/pool.go
+// DAEMON POOL: reusable length-prefixed connections per daemon socket
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_POOL_MAX_IDLE     = 4
+	DEFAULT_POOL_IDLE_TIMEOUT = 30 * time.Second
+	DEFAULT_POOL_MAX_LIFETIME = 5 * time.Minute
+
+	// A response frame larger than this is treated as a broken stream.
+	MAX_FRAME_BYTES = 16 << 20
+)
+
+// PoolConfig switches a daemon from one-shot connections (write, CloseWrite,
+// read to EOF) to pooled ones. A pooled daemon must speak length-prefixed
+// framing: every request and response is a 4-byte big-endian length
+// followed by that many bytes, any number of times per connection.
+type PoolConfig struct {
+	MaxIdle       int `json:"max_idle"`
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+	MaxLifetimeMs int `json:"max_lifetime_ms"`
+}
+
+func (p PoolConfig) maxIdle() int {
+	if p.MaxIdle <= 0 {
+		return DEFAULT_POOL_MAX_IDLE
+	}
+	return p.MaxIdle
+}
+
+func (p PoolConfig) idleTimeout() time.Duration {
+	if p.IdleTimeoutMs <= 0 {
+		return DEFAULT_POOL_IDLE_TIMEOUT
+	}
+	return time.Duration(p.IdleTimeoutMs) * time.Millisecond
+}
+
+func (p PoolConfig) maxLifetime() time.Duration {
+	if p.MaxLifetimeMs <= 0 {
+		return DEFAULT_POOL_MAX_LIFETIME
+	}
+	return time.Duration(p.MaxLifetimeMs) * time.Millisecond
+}
+
+func (p PoolConfig) validate(field string) []ConfigProblem {
+	var problems []ConfigProblem
+	check := func(name string, v int) {
+		if v < 0 {
+			problems = append(problems, ConfigProblem{Field: field + "." + name, Message: fmt.Sprintf("must be >= 0, got %d", v)})
+		}
+	}
+	check("max_idle", p.MaxIdle)
+	check("idle_timeout_ms", p.IdleTimeoutMs)
+	check("max_lifetime_ms", p.MaxLifetimeMs)
+	return problems
+}
+
+// daemonPool returns the pool settings for a daemon, or nil for one-shot.
+func (c *Config) daemonPool(name string) *PoolConfig {
+	for _, d := range c.Daemons {
+		if d.Name == name {
+			return d.Pool
+		}
+	}
+	return nil
+}
+
+// PoolStats counts connection reuse for one daemon socket.
+type PoolStats struct {
+	Socket    string `json:"socket"`
+	Idle      int    `json:"idle"`
+	Dials     int64  `json:"dials"`
+	Reuses    int64  `json:"reuses"`
+	Discarded int64  `json:"discarded"`
+}
+
+type pooledConn struct {
+	net.Conn
+	created  time.Time
+	lastUsed time.Time
+}
+
+// DaemonPool keeps up to MaxIdle framed connections to one daemon socket.
+// Connections idle longer than the idle timeout, or older than the max
+// lifetime, are closed instead of reused, so a restarted daemon is picked
+// up without waiting for a write to fail.
+type DaemonPool struct {
+	sock  string
+	mu    sync.Mutex
+	cfg   PoolConfig
+	idle  []*pooledConn
+	stats PoolStats
+}
+
+type poolRegistry struct {
+	mu    sync.Mutex
+	pools map[string]*DaemonPool
+}
+
+var daemonPools = &poolRegistry{pools: make(map[string]*DaemonPool)}
+
+// get returns the pool for sock, applying cfg so a reloaded config takes
+// effect on the next release.
+func (r *poolRegistry) get(sock string, cfg PoolConfig) *DaemonPool {
+	r.mu.Lock()
+	p, ok := r.pools[sock]
+	if !ok {
+		p = &DaemonPool{sock: sock, stats: PoolStats{Socket: sock}}
+		r.pools[sock] = p
+	}
+	r.mu.Unlock()
+
+	p.mu.Lock()
+	p.cfg = cfg
+	p.mu.Unlock()
+	return p
+}
+
+func (r *poolRegistry) Snapshot() []PoolStats {
+	r.mu.Lock()
+	pools := make([]*DaemonPool, 0, len(r.pools))
+	for _, p := range r.pools {
+		pools = append(pools, p)
+	}
+	r.mu.Unlock()
+
+	out := make([]PoolStats, 0, len(pools))
+	for _, p := range pools {
+		p.mu.Lock()
+		s := p.stats
+		s.Idle = len(p.idle)
+		p.mu.Unlock()
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Socket < out[j].Socket })
+	return out
+}
+
+func (p *DaemonPool) expired(c *pooledConn, now time.Time) bool {
+	return now.Sub(c.lastUsed) > p.cfg.idleTimeout() || now.Sub(c.created) > p.cfg.maxLifetime()
+}
+
+// acquire returns a live idle connection, or dials a new one. reused tells
+// the caller whether a failure may just mean the daemon dropped the socket.
+func (p *DaemonPool) acquire(ctx context.Context) (c *pooledConn, reused bool, err error) {
+	now := time.Now()
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !p.expired(c, now) {
+			p.stats.Reuses++
+			p.mu.Unlock()
+			return c, true, nil
+		}
+		p.stats.Discarded++
+		c.Close()
+	}
+	p.stats.Dials++
+	p.mu.Unlock()
+
+	conn, err := dialDaemon(ctx, p.sock, 1*time.Second)
+	if err != nil {
+		return nil, false, err
+	}
+	return &pooledConn{Conn: conn, created: now, lastUsed: now}, false, nil
+}
+
+// release returns c to the pool, or closes it if the exchange failed, the
+// pool is full or the connection has outlived its lifetime.
+func (p *DaemonPool) release(c *pooledConn, healthy bool) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !healthy || len(p.idle) >= p.cfg.maxIdle() || now.Sub(c.created) > p.cfg.maxLifetime() {
+		if healthy {
+			p.stats.Discarded++
+		}
+		c.Close()
+		return
+	}
+	c.lastUsed = now
+	p.idle = append(p.idle, c)
+}
+
+func writeFrameHeader(w io.Writer, n int64) error {
+	if n > math.MaxUint32 {
+		return fmt.Errorf("FRAME_TOO_LARGE: %d bytes", n)
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(n))
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	if err := writeFrameHeader(w, int64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MAX_FRAME_BYTES {
+		return nil, fmt.Errorf("FRAME_TOO_LARGE: %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *DaemonPool) exchange(c *pooledConn, data []byte) ([]Finding, error) {
+	if err := writeFrame(c, data); err != nil {
+		return nil, err
+	}
+	resp, err := readFrame(c)
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	json.Unmarshal(resp, &findings)
+	return findings, nil
+}
+
+// scan sends one framed request. A failure on a reused connection is
+// retried, since the daemon may have closed it; each retry drops that
+// connection, so at worst it ends on a fresh dial.
+func (p *DaemonPool) scan(ctx context.Context, data []byte) ([]Finding, error) {
+	for {
+		c, reused, err := p.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stop := watchConn(ctx, c)
+		findings, err := p.exchange(c, data)
+		p.release(c, rearm(c, stop, err))
+		if err == nil || !reused || ctx.Err() != nil {
+			return findings, err
+		}
+	}
+}
+
+// rearm ends a connection's request deadline so it can idle in the pool,
+// and reports whether it is still fit for reuse.
+func rearm(c *pooledConn, stop func() bool, err error) bool {
+	if !stop() || err != nil {
+		return false
+	}
+	return c.SetDeadline(time.Time{}) == nil
+}
+
+// callDaemon sends data to the daemon at sock, pooled if pool is set, and
+// retries transient failures as retry allows.
+func callDaemon(ctx context.Context, retry RetryConfig, sock string, pool *PoolConfig, data []byte) (findings []Finding, err error) {
+	err = retry.do(ctx, sock, func() error {
+		start := time.Now()
+		if pool == nil {
+			findings, err = scanWithDaemon(ctx, sock, data)
+		} else {
+			findings, err = daemonPools.get(sock, *pool).scan(ctx, data)
+		}
+		metrics.observeDaemon(sock, start, err)
+		noteDaemon(ctx, sock, start, err)
+		return err
+	})
+	return findings, err
+}
@@ -0,0 +1,140 @@
+// Vigilant/proxy/quorum.go
+// QUORUM: fan out to any number of scanners, tolerate some failing, vote
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Quorum verdict modes. QUORUM_SUM is the historical behavior.
+const (
+	QUORUM_SUM      = "sum"
+	QUORUM_ANY      = "any"
+	QUORUM_MAJORITY = "majority"
+)
+
+// QuorumConfig decides how the scanners' answers combine. Verdict sum
+// (default) scores every daemon's findings together; any scores each
+// daemon alone and blocks if one would; majority blocks if more than half
+// of the daemons that answered would. MinResponses is how many daemons must
+// answer for a verdict (0: all of them, apart from circuit-open daemons
+// skipped under fail_open); the others may fail or time out.
+type QuorumConfig struct {
+	Verdict      string `json:"verdict"`
+	MinResponses int    `json:"min_responses"`
+}
+
+// votes reports whether each daemon's findings are scored on their own.
+func (q QuorumConfig) votes() bool {
+	return q.Verdict == QUORUM_ANY || q.Verdict == QUORUM_MAJORITY
+}
+
+type daemonAddr struct {
+	Name, Socket string
+}
+
+// scanners lists the daemons every scan fans out to: shield and analyst,
+// then each non-shadow daemons entry with its own socket, in config order.
+func (c *Config) scanners() []daemonAddr {
+	out := []daemonAddr{{DAEMON_SHIELD, paths.ShieldSock}, {DAEMON_ANALYST, paths.AnalystSock}}
+	for _, d := range c.Daemons {
+		if !d.Shadow && d.Socket != "" {
+			out = append(out, daemonAddr{d.Name, d.Socket})
+		}
+	}
+	return out
+}
+
+func (c *Config) scannerNames() []string {
+	var names []string
+	for _, d := range c.scanners() {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+func (c *Config) daemonSocket(name string) string {
+	for _, d := range c.scanners() {
+		if d.Name == name {
+			return d.Socket
+		}
+	}
+	return ""
+}
+
+func (c *Config) validateQuorum() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	q := c.Quorum
+	switch q.Verdict {
+	case "", QUORUM_SUM, QUORUM_ANY, QUORUM_MAJORITY:
+	default:
+		add("quorum.verdict", "must be %q, %q or %q, got %q", QUORUM_SUM, QUORUM_ANY, QUORUM_MAJORITY, q.Verdict)
+	}
+	if n := len(c.scanners()); q.MinResponses < 0 || q.MinResponses > n {
+		add("quorum.min_responses", "must be between 0 and the %d scanners, got %d", n, q.MinResponses)
+	}
+	// Stages decide on the combined score as they go; a vote or a partial
+	// answer per stage has no clear meaning.
+	if len(c.ScorerChain.Stages) > 0 && (q.votes() || q.MinResponses > 0) {
+		add("quorum", "can't be combined with scorer_chain stages")
+	}
+	return problems
+}
+
+// daemonFindings is one daemon's answer, mapped through its send adapter.
+type daemonFindings struct {
+	name     string
+	findings []Finding
+}
+
+// quorumMet applies min_responses to a fan-out in which responded of total
+// daemons answered.
+func (q QuorumConfig) quorumMet(responded, total int) bool {
+	if q.MinResponses == 0 {
+		return responded == total
+	}
+	return responded >= q.MinResponses
+}
+
+// decideQuorum scores each daemon's findings on its own and votes. The
+// score reported is the highest one enough daemons reach to carry the vote:
+// the top score for any, the one a majority reach or exceed for majority.
+func decideQuorum(rules *scoringRules, answers []daemonFindings) ScanResult {
+	cfg := rules.cfg
+	need := 1
+	if cfg.Quorum.Verdict == QUORUM_MAJORITY {
+		need = len(answers)/2 + 1
+	}
+	var all []Finding
+	scores := make([]int, 0, len(answers))
+	blocks := 0
+	for _, a := range answers {
+		findings := cfg.Confidence.filter(a.findings)
+		if cfg.DedupeFindings {
+			findings = dedupeFindings(findings)
+		}
+		score := rules.score(findings)
+		if rules.blocks(findings, score) {
+			blocks++
+		}
+		scores = append(scores, score)
+		all = append(all, findings...)
+	}
+	if cfg.DedupeFindings {
+		all = dedupeFindings(all)
+	}
+	res := ScanResult{Verdict: VERDICT_PASS, Findings: all}
+	sort.Sort(sort.Reverse(sort.IntSlice(scores)))
+	if len(scores) >= need {
+		res.Score = scores[need-1]
+	}
+	if blocks >= need {
+		res.Verdict = VERDICT_BLOCK
+	}
+	return res
+}
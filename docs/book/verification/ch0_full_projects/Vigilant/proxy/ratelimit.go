@@ -0,0 +1,140 @@
+// Vigilant/proxy/ratelimit.go
+// RATE LIMIT: a token bucket per client, checked before any daemon work
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+
+// RateLimitConfig gives each client a bucket of Burst requests that refills
+// at Rate per second (0 disables the limit; Burst 0 means one second's
+// worth). A client is its certificate fingerprint, or its IP without mTLS.
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (c RateLimitConfig) burst() float64 {
+	if c.Burst > 0 {
+		return float64(c.Burst)
+	}
+	return max(1, math.Ceil(c.Rate))
+}
+
+func (c RateLimitConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	if c.Rate < 0 {
+		problems = append(problems, ConfigProblem{Field: "rate_limit.rate", Message: fmt.Sprintf("must be >= 0, got %g", c.Rate)})
+	}
+	if c.Burst < 0 {
+		problems = append(problems, ConfigProblem{Field: "rate_limit.burst", Message: fmt.Sprintf("must be >= 0, got %d", c.Burst)})
+	}
+	return problems
+}
+
+type RateLimitStats struct {
+	Clients int   `json:"clients"`
+	Limited int64 `json:"limited"`
+}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // logged as over the limit; cleared once a request passes
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	limited int64
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes one token from client's bucket. When the bucket is empty it
+// reports how long until the next token.
+func (l *rateLimiter) allow(cfg RateLimitConfig, client string, now time.Time) (bool, time.Duration) {
+	burst := cfg.burst()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(cfg, now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*cfg.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true, 0
+	}
+	l.limited++
+	if !b.limited {
+		b.limited = true
+		log.Printf("[RATE_LIMIT] %s is over %g req/s (burst %g)", client, cfg.Rate, burst)
+	}
+	return false, time.Duration((1 - b.tokens) / cfg.Rate * float64(time.Second))
+}
+
+// sweep drops buckets that have been idle long enough to refill: a full
+// bucket is the same as none, so forgetting it changes nothing. Callers
+// hold l.mu.
+func (l *rateLimiter) sweep(cfg RateLimitConfig, now time.Time) {
+	if now.Sub(l.swept) < RATE_LIMIT_SWEEP_INTERVAL {
+		return
+	}
+	l.swept = now
+	full := time.Duration(cfg.burst() / cfg.Rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *rateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimitStats{Clients: len(l.buckets), Limited: l.limited}
+}
+
+// clientIdentity is the leaf certificate's fingerprint, or the remote IP
+// when the request carries no client certificate.
+func clientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return certFingerprint(r.TLS.PeerCertificates[0].Raw)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// withRateLimit answers 429 once a client's bucket is empty. It runs ahead
+// of auth, so failed auth attempts are limited too.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig().RateLimit
+		if cfg.Rate > 0 {
+			if ok, wait := limiter.allow(cfg, clientIdentity(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
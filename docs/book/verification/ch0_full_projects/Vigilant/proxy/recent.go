@@ -0,0 +1,71 @@
+// Vigilant/proxy/recent.go
+// RECENT VERDICTS: bounded in-memory ring for incident debugging
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const RECENT_VERDICTS = 256
+
+// VerdictRecord is what the ring keeps per scan. It never holds the payload.
+type VerdictRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Path      string    `json:"path"`
+	Verdict   string    `json:"verdict"`
+	Score     int       `json:"score"`
+	Findings  []string  `json:"findings"`
+	Simulated bool      `json:"simulated,omitempty"`
+}
+
+type verdictRing struct {
+	mu   sync.Mutex
+	buf  []VerdictRecord
+	next int
+	full bool
+}
+
+var recentVerdicts = newVerdictRing(RECENT_VERDICTS)
+
+func newVerdictRing(size int) *verdictRing {
+	return &verdictRing{buf: make([]VerdictRecord, size)}
+}
+
+func (v *verdictRing) Add(requestID, path string, res ScanResult) {
+	types := make([]string, 0, len(res.Findings))
+	for _, f := range res.Findings {
+		types = append(types, f.Type)
+	}
+	rec := VerdictRecord{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Path:      path,
+		Verdict:   res.Verdict,
+		Score:     res.Score,
+		Findings:  types,
+		Simulated: res.Simulated,
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.buf[v.next] = rec
+	v.next = (v.next + 1) % len(v.buf)
+	if v.next == 0 {
+		v.full = true
+	}
+}
+
+// Snapshot returns the retained records, oldest first.
+func (v *verdictRing) Snapshot() []VerdictRecord {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.full {
+		return append([]VerdictRecord(nil), v.buf[:v.next]...)
+	}
+	out := make([]VerdictRecord, 0, len(v.buf))
+	out = append(out, v.buf[v.next:]...)
+	return append(out, v.buf[:v.next]...)
+}
@@ -0,0 +1,384 @@
+// Vigilant/proxy/recording.go
+// TRAFFIC RECORDING: capture daemon answers, replay them against a new policy
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_ENV = "VIGILANT_RECORD"
+
+	RECORD_DAEMON  = "daemon"
+	RECORD_VERDICT = "verdict"
+)
+
+// ScanRecording is one line of the recording. Each daemon call that answered
+// gets a RECORD_DAEMON line with the digest of the exact bytes sent and the
+// findings as scoring saw them (after the send adapter's mapping). They are
+// held until the document is decided and written together with its
+// RECORD_VERDICT line, so a scan that fails leaves nothing to replay.
+// DocumentSHA256 and RequestID tie them together. The body is only kept
+// with -capture-bodies, and never for /stream.
+type ScanRecording struct {
+	Kind           string    `json:"kind"`
+	Time           time.Time `json:"timestamp"`
+	RequestID      string    `json:"request_id,omitempty"`
+	DocumentSHA256 string    `json:"document_sha256"`
+
+	Daemon        string    `json:"daemon,omitempty"`
+	Socket        string    `json:"socket,omitempty"`
+	RequestSHA256 string    `json:"request_sha256,omitempty"`
+	Findings      []Finding `json:"findings,omitempty"`
+	Body          []byte    `json:"body,omitempty"`
+
+	Policy  string `json:"policy,omitempty"`
+	Verdict string `json:"verdict,omitempty"`
+	Score   int    `json:"score,omitempty"`
+}
+
+type recordWriter struct {
+	mu     sync.Mutex
+	f      *os.File
+	bodies bool
+}
+
+// recorder is nil unless -record is set.
+var recorder *recordWriter
+
+// Write appends recs as consecutive lines.
+func (w *recordWriter) Write(recs ...ScanRecording) {
+	var buf []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("[RECORD_FAIL] id=%s: %v", rec.RequestID, err)
+			return
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	w.mu.Lock()
+	_, err := w.f.Write(buf)
+	w.mu.Unlock()
+	if err != nil && len(recs) > 0 {
+		log.Printf("[RECORD_FAIL] id=%s: %v", recs[0].RequestID, err)
+	}
+}
+
+func initRecording(path string, bodies bool) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Fatalf("RECORD_OPEN_FAIL: %v", err)
+	}
+	recorder = &recordWriter{f: f, bodies: bodies}
+	if bodies {
+		log.Printf("[WARN] Recording daemon traffic to %s WITH raw request bodies", path)
+		return
+	}
+	log.Printf("[RECORD] Recording daemon traffic to %s (digests only)", path)
+}
+
+type recordKey struct{}
+
+// recordedDoc marks ctx as scanning one document that should be recorded,
+// and holds its daemon records until the verdict.
+type recordedDoc struct {
+	requestID string
+	digest    string
+
+	mu      sync.Mutex
+	daemons []ScanRecording
+}
+
+// withRecording marks ctx for recording when a recorder is open. Only
+// scanDocument and streamHandler do this, so warm-up and shadow calls are
+// never recorded.
+func withRecording(ctx context.Context, digest [sha256.Size]byte) context.Context {
+	if recorder == nil {
+		return ctx
+	}
+	doc := &recordedDoc{requestID: requestIDFrom(ctx), digest: hex.EncodeToString(digest[:])}
+	return context.WithValue(ctx, recordKey{}, doc)
+}
+
+func recordingFrom(ctx context.Context) *recordedDoc {
+	doc, _ := ctx.Value(recordKey{}).(*recordedDoc)
+	return doc
+}
+
+// recordDaemon holds one daemon's answer for the document's verdict.
+func recordDaemon(ctx context.Context, name, sock string, sent []byte, findings []Finding) {
+	doc := recordingFrom(ctx)
+	if doc == nil {
+		return
+	}
+	var body []byte
+	if recorder.bodies {
+		body = sent
+	}
+	doc.addDaemon(name, sock, sha256.Sum256(sent), body, findings)
+}
+
+// recordStreamedDaemon is recordDaemon for /stream, which never holds the
+// body: sent is the digest of what the daemon was sent.
+func recordStreamedDaemon(ctx context.Context, name, sock string, sent [sha256.Size]byte, findings []Finding) {
+	if doc := recordingFrom(ctx); doc != nil {
+		doc.addDaemon(name, sock, sent, nil, findings)
+	}
+}
+
+func (d *recordedDoc) addDaemon(name, sock string, sent [sha256.Size]byte, body []byte, findings []Finding) {
+	rec := ScanRecording{
+		Kind:           RECORD_DAEMON,
+		Time:           time.Now().UTC(),
+		RequestID:      d.requestID,
+		DocumentSHA256: d.digest,
+		Daemon:         name,
+		Socket:         sock,
+		RequestSHA256:  hex.EncodeToString(sent[:]),
+		Findings:       findings,
+		Body:           body,
+	}
+	d.mu.Lock()
+	d.daemons = append(d.daemons, rec)
+	d.mu.Unlock()
+}
+
+// recordVerdict writes the document's daemon records, then its verdict.
+func recordVerdict(ctx context.Context, rules *scoringRules, res ScanResult) {
+	doc := recordingFrom(ctx)
+	if doc == nil {
+		return
+	}
+	doc.mu.Lock()
+	recs := append(doc.daemons, ScanRecording{
+		Kind:           RECORD_VERDICT,
+		Time:           time.Now().UTC(),
+		RequestID:      doc.requestID,
+		DocumentSHA256: doc.digest,
+		Policy:         rules.name,
+		Verdict:        res.Verdict,
+		Score:          res.Score,
+	})
+	doc.daemons = nil
+	doc.mu.Unlock()
+	recorder.Write(recs...)
+}
+
+// replayedDoc is one recorded document decided again under the current config.
+type replayedDoc struct {
+	RequestID      string   `json:"request_id,omitempty"`
+	DocumentSHA256 string   `json:"document_sha256"`
+	Policy         string   `json:"policy"`
+	Was            string   `json:"was"`
+	WasScore       int      `json:"was_score"`
+	Now            string   `json:"now,omitempty"`
+	NowScore       int      `json:"now_score"`
+	Missing        []string `json:"missing_daemons,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type replayReport struct {
+	File     string        `json:"file"`
+	Policy   string        `json:"policy"`
+	Replayed int           `json:"replayed"`
+	Changed  []replayedDoc `json:"changed"`
+	Skipped  []replayedDoc `json:"skipped,omitempty"`
+}
+
+// runReplay is `replay [--json] [-policy path] <recording.jsonl>`. It exits
+// 0 when no verdict would change, 1 when some would, and 2 on errors.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "emit a machine-readable report")
+	policy := fs.String("policy", paths.Policy, "risk matrix file, or a policy directory, to replay against")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [--json] [-policy path] <recording.jsonl|->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// Allow flags after the file as well: `replay traffic.jsonl --json`.
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	file := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, problems, err := readConfig(*policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CONFIG_LOAD_FAIL: %v\n", err)
+		return 2
+	}
+	if len(problems) > 0 {
+		printValidateReport(os.Stderr, validateReport{File: *policy, Problems: problems})
+		return 2
+	}
+	in := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "REPLAY_READ_FAIL: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+	report, err := replayRecording(&cfg, in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPLAY_READ_FAIL: %v\n", err)
+		return 2
+	}
+	report.File, report.Policy = file, *policy
+
+	if *asJSON {
+		if report.Changed == nil {
+			report.Changed = []replayedDoc{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printReplayReport(os.Stdout, report)
+	}
+	if len(report.Changed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayRecording decides every recorded document again from its daemon
+// records, the way scanDocument would with cfg. Documents whose policy set
+// is gone, or with no recorded answer from the daemons cfg now needs, are
+// skipped.
+func replayRecording(cfg *Config, in io.Reader) (replayReport, error) {
+	type docKey struct{ requestID, digest string }
+	answers := make(map[docKey][]daemonFindings)
+	var report replayReport
+
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		var rec ScanRecording
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return report, fmt.Errorf("line %d: %v", n, err)
+		}
+		key := docKey{rec.RequestID, rec.DocumentSHA256}
+		switch rec.Kind {
+		case RECORD_DAEMON:
+			answers[key] = append(answers[key], daemonFindings{rec.Daemon, rec.Findings})
+		case RECORD_VERDICT:
+			doc := replayDocument(cfg, rec, answers[key])
+			delete(answers, key)
+			switch {
+			case doc.Error != "":
+				report.Skipped = append(report.Skipped, doc)
+			case doc.Now != doc.Was:
+				report.Changed = append(report.Changed, doc)
+			}
+			report.Replayed++
+		}
+	}
+	return report, sc.Err()
+}
+
+func replayDocument(cfg *Config, rec ScanRecording, answers []daemonFindings) replayedDoc {
+	doc := replayedDoc{
+		RequestID:      rec.RequestID,
+		DocumentSHA256: rec.DocumentSHA256,
+		Policy:         rec.Policy,
+		Was:            rec.Verdict,
+		WasScore:       rec.Score,
+	}
+	rules, ok := cfg.rulesNamed(rec.Policy)
+	if !ok {
+		doc.Error = fmt.Sprintf("policy set %q is no longer configured", rec.Policy)
+		return doc
+	}
+	byName := make(map[string][]Finding)
+	for _, a := range answers {
+		byName[a.name] = append(byName[a.name], a.findings...)
+	}
+	for _, n := range cfg.scannerNames() {
+		if _, ok := byName[n]; !ok {
+			doc.Missing = append(doc.Missing, n)
+		}
+	}
+	if len(answers) == 0 {
+		doc.Error = "no daemon answers recorded"
+		return doc
+	}
+
+	var res ScanResult
+	var err error
+	if cfg.Quorum.votes() {
+		res = decideQuorum(rules, answers)
+	} else {
+		res, err = decideChain(rules, replayStages(byName))
+	}
+	if err != nil {
+		doc.Error = fmt.Sprintf("a stage's daemons were never recorded (missing %v)", doc.Missing)
+		return doc
+	}
+	// The body may not be in the recording, so a redaction that would have
+	// failed to place its spans still counts as a redaction here.
+	if cfg.inRedactBand(res) {
+		res.Verdict = VERDICT_REDACT
+	}
+	doc.Now, doc.NowScore = res.Verdict, res.Score
+	return doc
+}
+
+// label names a document by request ID, or by its digest when the
+// recording has none.
+func (d replayedDoc) label() string {
+	if d.RequestID != "" {
+		return d.RequestID
+	}
+	if len(d.DocumentSHA256) > 12 {
+		return d.DocumentSHA256[:12]
+	}
+	return d.DocumentSHA256
+}
+
+func printReplayReport(w io.Writer, r replayReport) {
+	for _, d := range r.Changed {
+		fmt.Fprintf(w, "%s: %s (score %d) -> %s (score %d)", d.label(), d.Was, d.WasScore, d.Now, d.NowScore)
+		if len(d.Missing) > 0 {
+			fmt.Fprintf(w, ", not recorded: %v", d.Missing)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, d := range r.Skipped {
+		fmt.Fprintf(w, "%s: skipped: %s\n", d.label(), d.Error)
+	}
+	fmt.Fprintf(w, "%s: %d document(s) replayed against %s, %d verdict(s) would change",
+		r.File, r.Replayed, r.Policy, len(r.Changed))
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(w, ", %d skipped", len(r.Skipped))
+	}
+	fmt.Fprintln(w)
+}
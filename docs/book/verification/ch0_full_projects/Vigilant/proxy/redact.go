@@ -0,0 +1,109 @@
+// Vigilant/proxy/redact.go
+// REDACTION: pass mid-risk documents through with finding spans masked
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+const (
+	VERDICT_REDACT = "SECURE_REDACT"
+	DEFAULT_MASK   = "*"
+)
+
+// RedactionConfig turns on the thresholds.redact band: documents scoring at
+// least Redact but below the block verdict are answered with their finding
+// spans overwritten by Mask instead of a plain pass.
+type RedactionConfig struct {
+	Enabled bool   `json:"enabled"`
+	Mask    string `json:"mask"`
+}
+
+func (r RedactionConfig) maskByte() byte {
+	if r.Mask == "" {
+		return DEFAULT_MASK[0]
+	}
+	return r.Mask[0]
+}
+
+func (r RedactionConfig) validate() []ConfigProblem {
+	if r.Mask != "" && (len(r.Mask) != 1 || r.Mask[0] >= 0x80) {
+		return []ConfigProblem{{Field: "redaction.mask", Message: fmt.Sprintf("must be a single ASCII character, got %q", r.Mask)}}
+	}
+	return nil
+}
+
+// contentOffset maps an offset in what the daemon received back to the
+// scanned content. Envelope offsets point into JSON and can't be mapped.
+func (a SendAdapter) contentOffset(off int) (int, bool) {
+	switch a.Format {
+	case "", SEND_RAW:
+		return off, true
+	case SEND_PREFIX:
+		return off - len(a.Prefix), off >= len(a.Prefix)
+	}
+	return 0, false
+}
+
+// mapFindings moves finding offsets into the scanned content, clearing any
+// span that can't be mapped.
+func (a SendAdapter) mapFindings(findings []Finding) []Finding {
+	for i := range findings {
+		f := &findings[i]
+		if off, ok := a.contentOffset(f.Offset); ok {
+			f.Offset = off
+		} else {
+			f.Offset, f.Length = 0, 0
+		}
+	}
+	return findings
+}
+
+// maskSpans returns a copy of body with every finding span overwritten. It
+// fails if any finding has no span or one outside the body, since an
+// incomplete redaction would leak.
+func maskSpans(body []byte, findings []Finding, mask byte) ([]byte, error) {
+	out := bytes.Clone(body)
+	for _, f := range findings {
+		if f.Length <= 0 {
+			return nil, fmt.Errorf("%s finding has no span", f.Type)
+		}
+		if f.Offset < 0 || f.Offset+f.Length > len(out) {
+			return nil, fmt.Errorf("%s span [%d,+%d) is outside the %d-byte body", f.Type, f.Offset, f.Length, len(out))
+		}
+		for i := f.Offset; i < f.Offset+f.Length; i++ {
+			out[i] = mask
+		}
+	}
+	return out, nil
+}
+
+// inRedactBand reports whether a passing result should be redacted.
+func (c *Config) inRedactBand(res ScanResult) bool {
+	return c.Redaction.Enabled && res.Verdict == VERDICT_PASS && len(res.Findings) > 0 && res.Score >= c.Thresholds.Redact
+}
+
+// applyRedaction moves a passing result into the redact band when the
+// config asks for it. Spans are relative to the scanned content; validation
+// rejects redaction with scan_field, and a span that can't be placed blocks
+// the document rather than passing it half-masked.
+func applyRedaction(cfg *Config, res *ScanResult, body, content []byte) {
+	if !cfg.inRedactBand(*res) {
+		return
+	}
+	var err error
+	if !bytes.Equal(body, content) {
+		err = fmt.Errorf("spans are relative to scan_field, not the body")
+	} else {
+		res.Redacted, err = maskSpans(body, res.Findings, cfg.Redaction.maskByte())
+	}
+	if err != nil {
+		log.Printf("[REDACT_FAIL] Score: %d, blocking instead: %v", res.Score, err)
+		res.Verdict = VERDICT_BLOCK
+		return
+	}
+	res.Verdict = VERDICT_REDACT
+}
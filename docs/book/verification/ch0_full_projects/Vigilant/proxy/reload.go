@@ -0,0 +1,115 @@
+// Vigilant/proxy/reload.go
+// HOT RELOAD: pick up policy edits without restarting the gateway
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_RELOAD_INTERVAL = 2 * time.Second
+
+// configFingerprint summarizes the name, size and mtime of every file the
+// config is read from, so any edit, addition or removal changes it.
+func configFingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+	entries, err := filepath.Glob(filepath.Join(path, "*.json"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(entries)
+	var b strings.Builder
+	for _, e := range entries {
+		fi, err := os.Stat(e)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d/%d;", filepath.Base(e), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// reloadConfig re-reads the policy source and swaps it in only if it is
+// valid. On any problem the running config stays in place.
+func reloadConfig(reason string) bool {
+	if err := refreshIntegrity(false); err != nil {
+		log.Printf("[CONFIG_RELOAD_FAIL] %v (keeping current config)", err)
+		return false
+	}
+	cfg, problems, err := readConfig(policySource)
+	if err != nil {
+		log.Printf("[CONFIG_RELOAD_FAIL] %s: %v (keeping current config)", policySource, err)
+		return false
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Printf("[CONFIG_RELOAD_FAIL] %s: %v", policySource, p)
+		}
+		log.Printf("[CONFIG_RELOAD_FAIL] %d problem(s) in %s (keeping current config)", len(problems), policySource)
+		return false
+	}
+	old := currentConfig()
+	liveConfig.Store(&cfg)
+	scanCache.reset(&cfg)
+	log.Printf("[CONFIG_RELOAD] %s reloaded (%s), %d policies", policySource, reason, len(cfg.Policies))
+	if cfg.Simulate.Enabled != old.Simulate.Enabled {
+		logSimulateMode(&cfg)
+	}
+	// These are only read at startup.
+	if cfg.Audit.Path != old.Audit.Path {
+		log.Printf("[CONFIG_RELOAD] audit.path change takes effect after a restart")
+	}
+	if cfg.AccessLog.Path != old.AccessLog.Path {
+		log.Printf("[CONFIG_RELOAD] access_log.path change takes effect after a restart")
+	}
+	if cfg.Warm != old.Warm {
+		log.Printf("[CONFIG_RELOAD] warm changes take effect after a restart")
+	}
+	return true
+}
+
+// watchConfig reloads on SIGHUP and whenever the policy files change, checked
+// every interval (0 disables polling; SIGHUP still works).
+func watchConfig(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last, _ := configFingerprint(policySource)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		tick = t.C
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				last, _ = configFingerprint(policySource)
+				reloadConfig("SIGHUP")
+			case <-tick:
+				fp, err := configFingerprint(policySource)
+				if err != nil || fp == last {
+					continue
+				}
+				// Remember the fingerprint even on failure, so a broken file is
+				// reported once rather than on every tick.
+				last = fp
+				reloadConfig("file changed")
+			}
+		}
+	}()
+}
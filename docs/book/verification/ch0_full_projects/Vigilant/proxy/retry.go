@@ -0,0 +1,92 @@
+// Vigilant/proxy/retry.go
+// DAEMON RETRY: ride out daemon restarts with jittered exponential backoff
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_RETRY_BASE_DELAY = 10 * time.Millisecond
+
+// RetryConfig retries a daemon call that failed in a way a restarting daemon
+// fails: socket missing or refusing, connection reset, timeout. Attempt n
+// waits BaseDelayMs*2^(n-1) plus up to JitterMs at random, so callers that
+// failed together don't retry together. MaxAttempts counts the first try;
+// 0 or 1 never retries.
+type RetryConfig struct {
+	MaxAttempts int `json:"max_attempts"`
+	BaseDelayMs int `json:"base_delay_ms"`
+	JitterMs    int `json:"jitter_ms"`
+}
+
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	base := DEFAULT_RETRY_BASE_DELAY
+	if r.BaseDelayMs > 0 {
+		base = time.Duration(r.BaseDelayMs) * time.Millisecond
+	}
+	d := base << (attempt - 1)
+	if r.JitterMs > 0 {
+		d += rand.N(time.Duration(r.JitterMs) * time.Millisecond)
+	}
+	return d
+}
+
+func (r RetryConfig) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	check := func(field string, v int) {
+		if v < 0 {
+			problems = append(problems, ConfigProblem{Field: "retry." + field, Message: fmt.Sprintf("must be >= 0, got %d", v)})
+		}
+	}
+	check("max_attempts", r.MaxAttempts)
+	check("base_delay_ms", r.BaseDelayMs)
+	check("jitter_ms", r.JitterMs)
+	if r.MaxAttempts > 10 {
+		problems = append(problems, ConfigProblem{Field: "retry.max_attempts", Message: fmt.Sprintf("must be <= 10, got %d", r.MaxAttempts)})
+	}
+	return problems
+}
+
+// retryable reports whether err looks transient. Anything else, the
+// descriptor limit included, fails at once: retrying wouldn't help.
+func retryable(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// do runs op until it succeeds, fails for good, or runs out of attempts.
+// It never sleeps past ctx's deadline: a retry that couldn't start before
+// the deadline isn't tried, and the last error is returned instead.
+func (r RetryConfig) do(ctx context.Context, sock string, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= r.MaxAttempts || !retryable(err) {
+			return err
+		}
+		delay := r.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		log.Printf("[DAEMON_RETRY] %s attempt %d/%d in %s: %v", sock, attempt+1, r.MaxAttempts, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Vigilant/proxy/routes.go
+// ROUTING: every endpoint and the middleware policy it runs under
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h so that mws run in the order given (first = outermost).
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// newRouter wires all endpoints. Scan paths require the auth key; admin
+// paths added later get their own (lighter) policy here. Health probes
+// and /metrics need neither.
+func newRouter() *http.ServeMux {
+	scan := func(route string, extra ...middleware) []middleware {
+		return append([]middleware{withRequestLog, withAccessLog, withMetrics(route), withWarmGate, withFDLimit, withTracing, withCertPin, withRateLimit, withAuth, withPolicyOverride}, extra...)
+	}
+	admin := []middleware{withRequestLog, withCertPin, withAuth, withMethods(http.MethodGet)}
+
+	mux := http.NewServeMux()
+	healthRoutes(mux)
+	mux.Handle("/debug/state", chain(http.HandlerFunc(stateHandler), admin...))
+	mux.Handle("/stream", chain(http.HandlerFunc(streamHandler), scan("/stream", withMethods(http.MethodPost))...))
+	mux.Handle("/batch", chain(http.HandlerFunc(batchHandler), scan("/batch", withMethods(http.MethodPost))...))
+	mux.Handle("/", chain(http.HandlerFunc(handler), scan("/")...))
+	return mux
+}
+
+// withAuth enforces the X-Vigilant-Auth second factor.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func withMethods(methods ...string) middleware {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, m := range methods {
+				if r.Method == m {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})
+	}
+}
+
+// statusRecorder captures the status code written by downstream handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// requestID returns the caller's X-Request-ID if it is sane, else a fresh one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 64 && !strings.ContainsAny(id, " \t\r\n") {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the X-Request-ID withRequestLog assigned, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestLog tags the request with an X-Request-ID and logs one line per
+// request once it completes.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("[REQUEST] id=%s %s %s %d %s", id, r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,190 @@
+// Vigilant/proxy/scancli.go
+// SCAN COMMAND: send a file to a running gateway and report its verdict
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SCAN_CLI_TIMEOUT = 30 * time.Second
+
+// scanReport is what `scan` learned from the gateway's answer. The score,
+// threshold and findings are only known when the gateway exposes them
+// (expose_findings, or a signed verdict for the score).
+type scanReport struct {
+	File      string   `json:"file"`
+	Bytes     int      `json:"bytes"`
+	Status    int      `json:"status"`
+	RequestID string   `json:"request_id,omitempty"`
+	Verdict   string   `json:"verdict"`
+	Score     *int     `json:"score,omitempty"`
+	Threshold *int     `json:"threshold,omitempty"`
+	Findings  []string `json:"findings,omitempty"`
+	Redacted  int      `json:"redacted_spans,omitempty"`
+	Simulated bool     `json:"simulated,omitempty"`
+}
+
+// runScan is `scan [--json] [-gateway url] <file|->`. It exits 0 when the
+// document passes or is redacted, 1 when it is blocked, and 2 when it
+// couldn't be scanned.
+func runScan(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "emit a machine-readable report")
+	gateway := fs.String("gateway", DEFAULT_GATEWAY_URL, "running gateway to scan with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s scan [--json] [-gateway url] <file|->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// Allow flags after the file as well: `scan doc.txt --json`.
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	file := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var body []byte
+	var err error
+	if file == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SCAN_READ_FAIL: %v\n", err)
+		return 2
+	}
+	initSecrets()
+	report, err := scanWithGateway(*gateway, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SCAN_FAIL: %v\n", err)
+		return 2
+	}
+	report.File = file
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printScanReport(os.Stdout, report)
+	}
+	if report.Verdict == VERDICT_BLOCK && !report.Simulated {
+		return 1
+	}
+	return 0
+}
+
+// scanWithGateway posts body to the gateway's scan endpoint over mTLS, with
+// the same PKI paths and auth key the gateway itself uses.
+func scanWithGateway(base string, body []byte) (scanReport, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return scanReport{}, err
+	}
+	client, err := newMTLSClient(u.Hostname(), SCAN_CLI_TIMEOUT)
+	if err != nil {
+		return scanReport{}, err
+	}
+	key, err := authKey()
+	if err != nil {
+		return scanReport{}, err
+	}
+	req, err := newGatewayRequest("POST", strings.TrimRight(base, "/")+"/", bytes.NewReader(body), key)
+	if err != nil {
+		return scanReport{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return scanReport{}, err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return scanReport{}, err
+	}
+
+	report := scanReport{Bytes: len(body), Status: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+	switch {
+	case resp.StatusCode == 403 && strings.Contains(string(reply), "Enterprise Policy Violation"):
+		report.Verdict = VERDICT_BLOCK
+	case resp.StatusCode != 200:
+		return report, fmt.Errorf("gateway answered %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	case resp.Header.Get(SIMULATED_HEADER) == "true":
+		report.Verdict = resp.Header.Get(SIMULATED_VERDICT_HEADER)
+		report.Simulated = true
+	case resp.Header.Get("X-Vigilant-Redacted") != "":
+		report.Verdict = VERDICT_REDACT
+		report.Redacted, _ = strconv.Atoi(resp.Header.Get("X-Vigilant-Redacted"))
+	default:
+		report.Verdict = VERDICT_PASS
+	}
+
+	// The signed envelope carries the score even without expose_findings.
+	// It is only read here, not verified: this is a developer tool.
+	if raw, err := base64.RawURLEncoding.DecodeString(resp.Header.Get("X-Vigilant-Verdict")); err == nil && len(raw) > 0 {
+		var env VerdictEnvelope
+		if json.Unmarshal(raw, &env) == nil {
+			report.Score = &env.Score
+		}
+	}
+	if v, err := strconv.Atoi(resp.Header.Get(SCORE_HEADER)); err == nil {
+		report.Score = &v
+	}
+	if v, err := strconv.Atoi(resp.Header.Get(THRESHOLD_HEADER)); err == nil {
+		report.Threshold = &v
+	}
+	if v := resp.Header.Get(FINDINGS_HEADER); v != "" {
+		report.Findings = strings.Split(v, ",")
+	}
+	return report, nil
+}
+
+func printScanReport(w io.Writer, r scanReport) {
+	verdict := r.Verdict
+	if r.Simulated {
+		verdict += " (simulated, not enforced)"
+	}
+	score := "not exposed"
+	if r.Score != nil {
+		score = strconv.Itoa(*r.Score)
+		if r.Threshold != nil {
+			score += fmt.Sprintf(" (block at %d)", *r.Threshold)
+		}
+	}
+	fmt.Fprintf(w, "%-10s %s (%d bytes)\n", "File:", r.File, r.Bytes)
+	fmt.Fprintf(w, "%-10s %s\n", "Verdict:", verdict)
+	fmt.Fprintf(w, "%-10s %s\n", "Score:", score)
+	switch {
+	case len(r.Findings) > 0:
+		fmt.Fprintf(w, "%-10s %s\n", "Findings:", strings.Join(r.Findings, ", "))
+	case r.Redacted > 0:
+		fmt.Fprintf(w, "%-10s %d span(s) redacted\n", "Findings:", r.Redacted)
+	case r.Verdict == VERDICT_BLOCK:
+		fmt.Fprintf(w, "%-10s not exposed (set expose_findings)\n", "Findings:")
+	}
+	if r.RequestID != "" {
+		fmt.Fprintf(w, "%-10s %s\n", "Request:", r.RequestID)
+	}
+}
@@ -0,0 +1,266 @@
+// Vigilant/proxy/scorer.go
+// SCORER CHAIN: staged daemon calls, cheap stages decide first
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Stage decisions. Only DECISION_DEFER moves on to the next stage.
+const (
+	DECISION_BLOCK = "block"
+	DECISION_ALLOW = "allow"
+	DECISION_DEFER = "defer"
+)
+
+// ScorerStage calls its daemons in parallel and decides on the findings of
+// every stage so far. It blocks at BlockAt (default: the request's policy
+// verdict) and allows below AllowBelow (default: never allows early).
+type ScorerStage struct {
+	Name       string   `json:"name"`
+	Daemons    []string `json:"daemons"`
+	BlockAt    int      `json:"block_at"`
+	AllowBelow int      `json:"allow_below"`
+}
+
+// ScorerChain replaces the single all-daemons call. OnFinalDefer is the
+// verdict when the last stage still defers: allow (default) or block.
+type ScorerChain struct {
+	Stages       []ScorerStage `json:"stages"`
+	OnFinalDefer string        `json:"on_final_defer"`
+}
+
+// stages returns the configured stages, or the historical behavior: one
+// stage with every scanner, scored by policy alone.
+func (c ScorerChain) stages(scanners []string) []ScorerStage {
+	if len(c.Stages) == 0 {
+		return []ScorerStage{{Name: "default", Daemons: scanners}}
+	}
+	return c.Stages
+}
+
+func (c ScorerChain) validate(scanners []string) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(field, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	switch c.OnFinalDefer {
+	case "", DECISION_ALLOW, DECISION_BLOCK:
+	default:
+		add("scorer_chain.on_final_defer", "must be %q or %q, got %q", DECISION_ALLOW, DECISION_BLOCK, c.OnFinalDefer)
+	}
+	used := make(map[string]string)
+	for i, st := range c.Stages {
+		field := fmt.Sprintf("scorer_chain.stages[%d]", i)
+		if len(st.Daemons) == 0 {
+			add(field+".daemons", "must name at least one daemon")
+		}
+		for j, d := range st.Daemons {
+			df := fmt.Sprintf("%s.daemons[%d]", field, j)
+			switch {
+			case !slices.Contains(scanners, d):
+				add(df, "unknown daemon %q (want one of %s)", d, strings.Join(scanners, ", "))
+			case used[d] != "":
+				add(df, "daemon %q already runs in %s", d, used[d])
+			}
+			used[d] = field
+		}
+		if st.BlockAt < 0 {
+			add(field+".block_at", "must be >= 0, got %d", st.BlockAt)
+		}
+		if st.AllowBelow < 0 {
+			add(field+".allow_below", "must be >= 0, got %d", st.AllowBelow)
+		}
+		if st.BlockAt > 0 && st.AllowBelow > st.BlockAt {
+			add(field+".allow_below", "must be <= block_at (%d), got %d", st.BlockAt, st.AllowBelow)
+		}
+	}
+	return problems
+}
+
+func (st ScorerStage) decide(rules *scoringRules, findings []Finding, score int) string {
+	if st.BlockAt > 0 {
+		if score >= st.BlockAt {
+			return DECISION_BLOCK
+		}
+	} else if rules.blocks(findings, score) {
+		return DECISION_BLOCK
+	}
+	if score < st.AllowBelow {
+		return DECISION_ALLOW
+	}
+	return DECISION_DEFER
+}
+
+// scanDaemons sends content to each named daemon and returns every
+// answer's findings together. complete is as for scanEach.
+func scanDaemons(ctx context.Context, cfg *Config, names []string, content []byte) (all []Finding, complete bool, err error) {
+	answers, complete, err := scanEach(ctx, cfg, names, content)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, a := range answers {
+		all = append(all, a.findings...)
+	}
+	return all, complete, nil
+}
+
+// scanEach sends content to each named daemon in parallel, through its send
+// adapter and circuit breaker, one client span per call. It returns the
+// answers, in names order, once quorum.min_responses is met; without it,
+// every daemon must answer. complete reports whether every named daemon
+// answered, circuit-open daemons skipped under fail_open included.
+func scanEach(ctx context.Context, cfg *Config, names []string, content []byte) (answers []daemonFindings, complete bool, err error) {
+	type call struct {
+		i          int
+		name, sock string
+		span       *Span
+		body       []byte
+		findings   []Finding
+		err        error
+	}
+	calls := make([]*call, len(names))
+	for i, name := range names {
+		_, span := startSpan(ctx, "scan "+name, SPAN_KIND_CLIENT)
+		defer span.End()
+		body, err := cfg.sendAdapter(name).Transform(content, span.Traceparent())
+		if err != nil {
+			return nil, false, err
+		}
+		calls[i] = &call{i: i, name: name, sock: cfg.daemonSocket(name), span: span, body: body}
+	}
+
+	// Results come back over a channel, so a call still running when ctx
+	// ends is never read. Its connection carries ctx's deadline, so it ends
+	// on its own soon after.
+	results := make(chan *call, len(calls))
+	for _, c := range calls {
+		go func(c *call) {
+			c.findings, c.err = guardedCall(ctx, cfg, c.sock, cfg.daemonPool(c.name), c.body)
+			traceDaemon(c.span, c.sock, c.findings, c.err)
+			results <- c
+		}(c)
+	}
+	done := make([]*call, len(calls))
+collect:
+	for range calls {
+		select {
+		case c := <-results:
+			done[c.i] = c
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	// With on_open fail_open, circuit-open daemons are skipped, but at least
+	// one daemon must have scanned the content. With fail_closed, a
+	// circuit-open daemon that leaves the content without a verdict makes
+	// it errCircuitOpen, which blocks it.
+	expected := 0
+	circuitOpen := false
+	for i, c := range done {
+		if c != nil && errors.Is(c.err, errCircuitOpen) {
+			if cfg.Breaker.failOpen() {
+				continue
+			}
+			circuitOpen = true
+		}
+		expected++
+		if c == nil || c.err != nil {
+			continue
+		}
+		findings := cfg.sendAdapter(c.name).mapFindings(c.findings)
+		recordDaemon(ctx, c.name, c.sock, c.body, findings)
+		answers = append(answers, daemonFindings{names[i], findings})
+	}
+	if len(answers) == 0 || !cfg.Quorum.quorumMet(len(answers), expected) {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		if circuitOpen {
+			return nil, false, errCircuitOpen
+		}
+		return nil, false, errDaemonUnavailable
+	}
+	if len(answers) < expected {
+		log.Printf("[QUORUM] %d of %d daemons answered, quorum met", len(answers), expected)
+	}
+	return answers, len(answers) == len(names), nil
+}
+
+// runChain runs the scorer stages in order until one blocks or allows. A
+// voting quorum skips the chain: every scanner answers, then they vote.
+func runChain(ctx context.Context, rules *scoringRules, content []byte) (ScanResult, error) {
+	if rules.cfg.Quorum.votes() {
+		answers, complete, err := scanEach(ctx, rules.cfg, rules.cfg.scannerNames(), content)
+		if err != nil {
+			return ScanResult{}, err
+		}
+		res := decideQuorum(rules, answers)
+		res.Partial = !complete
+		return res, nil
+	}
+	partial := false
+	res, err := decideChain(rules, func(names []string) ([]Finding, error) {
+		findings, complete, err := scanDaemons(ctx, rules.cfg, names, content)
+		partial = partial || !complete
+		return findings, err
+	})
+	res.Partial = partial
+	return res, err
+}
+
+// replayStages is a decideChain scan over answers already collected per
+// daemon. A stage none of whose daemons answered fails as it would live.
+func replayStages(byName map[string][]Finding) func(names []string) ([]Finding, error) {
+	return func(names []string) ([]Finding, error) {
+		var out []Finding
+		scanned := 0
+		for _, n := range names {
+			if f, ok := byName[n]; ok {
+				out = append(out, f...)
+				scanned++
+			}
+		}
+		if scanned == 0 {
+			return nil, errDaemonUnavailable
+		}
+		return out, nil
+	}
+}
+
+// decideChain applies the stage decisions to the findings scan returns for
+// each stage's daemons, in order.
+func decideChain(rules *scoringRules, scan func(names []string) ([]Finding, error)) (ScanResult, error) {
+	cfg := rules.cfg
+	chain := cfg.ScorerChain
+	var all []Finding
+	for _, st := range chain.stages(cfg.scannerNames()) {
+		findings, err := scan(st.Daemons)
+		if err != nil {
+			return ScanResult{}, err
+		}
+		all = append(all, cfg.Confidence.filter(findings)...)
+		if cfg.DedupeFindings {
+			all = dedupeFindings(all)
+		}
+		score := rules.score(all)
+		switch st.decide(rules, all, score) {
+		case DECISION_BLOCK:
+			return ScanResult{Verdict: VERDICT_BLOCK, Score: score, Findings: all}, nil
+		case DECISION_ALLOW:
+			return ScanResult{Verdict: VERDICT_PASS, Score: score, Findings: all}, nil
+		}
+	}
+	res := ScanResult{Verdict: VERDICT_PASS, Score: rules.score(all), Findings: all}
+	if chain.OnFinalDefer == DECISION_BLOCK {
+		res.Verdict = VERDICT_BLOCK
+	}
+	return res, nil
+}
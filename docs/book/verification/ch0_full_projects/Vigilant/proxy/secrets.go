@@ -0,0 +1,73 @@
+// Vigilant/proxy/secrets.go
+// FILE-BACKED SECRET STORE (Kubernetes/Docker secrets layout)
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret names looked up in the secret directory (one file per secret).
+const (
+	SECRET_AUTH_KEY = "auth_key"
+)
+
+type cachedSecret struct {
+	value   []byte
+	modTime time.Time
+	size    int64
+}
+
+// SecretStore reads secrets from a directory of files, one secret per file.
+// Values are cached and transparently reloaded when the file changes.
+type SecretStore struct {
+	dir   string
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+func NewSecretStore(dir string) *SecretStore {
+	return &SecretStore{dir: dir, cache: make(map[string]cachedSecret)}
+}
+
+// Get returns the named secret with trailing newlines stripped. Files that
+// are readable or writable by "other" are refused outright.
+func (s *SecretStore) Get(name string) ([]byte, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("SECRET_NAME_INVALID: %q", name)
+	}
+	path := filepath.Join(s.dir, name)
+
+	// Stat follows symlinks on purpose: Kubernetes projects secrets through
+	// a ..data symlink, and it is the target's mode that matters.
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("SECRET_UNAVAILABLE: %s: %w", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("SECRET_NOT_REGULAR: %s", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o007 != 0 {
+		return nil, fmt.Errorf("SECRET_INSECURE_PERMS: %s has mode %04o (must not be accessible to others)", path, perm)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.cache[name]; ok && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("SECRET_UNAVAILABLE: %s: %w", name, err)
+	}
+	value := bytes.TrimRight(data, "\r\n")
+	s.cache[name] = cachedSecret{value: value, modTime: info.ModTime(), size: info.Size()}
+	return value, nil
+}
@@ -0,0 +1,150 @@
+// Vigilant/proxy/shadow.go
+// SHADOW DAEMONS: A/B evaluation on live traffic, never in the verdict path
+
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// At most this many shadow scans run at once; beyond that copies are dropped
+// rather than queued so a slow candidate can't build up memory.
+const SHADOW_MAX_INFLIGHT = 32
+
+// ShadowStats compares one shadow daemon against the authoritative daemons.
+type ShadowStats struct {
+	Name        string           `json:"name"`
+	Scans       int64            `json:"scans"`
+	Errors      int64            `json:"errors"`
+	Dropped     int64            `json:"dropped"`
+	Agree       int64            `json:"verdict_agree"`
+	Disagree    int64            `json:"verdict_disagree"`
+	OnlyShadow  map[string]int64 `json:"only_shadow_types"`
+	OnlyPrimary map[string]int64 `json:"only_primary_types"`
+}
+
+type shadowTracker struct {
+	mu       sync.Mutex
+	stats    map[string]*ShadowStats
+	inflight chan struct{}
+}
+
+var shadows = &shadowTracker{stats: make(map[string]*ShadowStats), inflight: make(chan struct{}, SHADOW_MAX_INFLIGHT)}
+
+func (t *shadowTracker) entry(name string) *ShadowStats {
+	s, ok := t.stats[name]
+	if !ok {
+		s = &ShadowStats{Name: name, OnlyShadow: make(map[string]int64), OnlyPrimary: make(map[string]int64)}
+		t.stats[name] = s
+	}
+	return s
+}
+
+func (t *shadowTracker) Snapshot() []ShadowStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]ShadowStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		c := *s
+		c.OnlyShadow = make(map[string]int64, len(s.OnlyShadow))
+		c.OnlyPrimary = make(map[string]int64, len(s.OnlyPrimary))
+		for k, v := range s.OnlyShadow {
+			c.OnlyShadow[k] = v
+		}
+		for k, v := range s.OnlyPrimary {
+			c.OnlyPrimary[k] = v
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func findingTypes(findings []Finding) map[string]bool {
+	types := make(map[string]bool)
+	for _, f := range findings {
+		types[f.Type] = true
+	}
+	return types
+}
+
+func diffTypes(a, b map[string]bool) []string {
+	var out []string
+	for t := range a {
+		if !b[t] {
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// runShadows sends content to every shadow daemon in the background and
+// compares what each finds with the authoritative result. It returns at once.
+func runShadows(content []byte, rules *scoringRules, primary ScanResult) {
+	for _, d := range rules.cfg.Daemons {
+		if !d.Shadow {
+			continue
+		}
+		select {
+		case shadows.inflight <- struct{}{}:
+		default:
+			shadows.mu.Lock()
+			shadows.entry(d.Name).Dropped++
+			shadows.mu.Unlock()
+			continue
+		}
+		go func(d DaemonConfig) {
+			defer func() { <-shadows.inflight }()
+			shadowScan(d, content, rules, primary)
+		}(d)
+	}
+}
+
+func shadowScan(d DaemonConfig, content []byte, rules *scoringRules, primary ScanResult) {
+	body, err := d.Send.Transform(content, "")
+	var findings []Finding
+	if err == nil {
+		// Shadows outlive the request, so they get a timeout of their own.
+		ctx, cancel := context.WithTimeout(context.Background(), rules.cfg.requestTimeout())
+		findings, err = guardedCall(ctx, rules.cfg, d.Socket, d.Pool, body)
+		cancel()
+	}
+
+	shadows.mu.Lock()
+	defer shadows.mu.Unlock()
+	s := shadows.entry(d.Name)
+	s.Scans++
+	if err != nil {
+		s.Errors++
+		return
+	}
+
+	findings = rules.cfg.Confidence.filter(findings)
+	if rules.cfg.DedupeFindings {
+		findings = dedupeFindings(findings)
+	}
+	score := rules.score(findings)
+	verdict := VERDICT_PASS
+	if rules.blocks(findings, score) {
+		verdict = VERDICT_BLOCK
+	}
+	shadowTypes, primaryTypes := findingTypes(findings), findingTypes(primary.Findings)
+	onlyShadow, onlyPrimary := diffTypes(shadowTypes, primaryTypes), diffTypes(primaryTypes, shadowTypes)
+	for _, t := range onlyShadow {
+		s.OnlyShadow[t]++
+	}
+	for _, t := range onlyPrimary {
+		s.OnlyPrimary[t]++
+	}
+	if verdict == primary.Verdict {
+		s.Agree++
+		return
+	}
+	s.Disagree++
+	log.Printf("[SHADOW_DIFF] daemon=%s primary=%s/%d shadow=%s/%d only_shadow=%v only_primary=%v",
+		d.Name, primary.Verdict, primary.Score, verdict, score, onlyShadow, onlyPrimary)
+}
@@ -0,0 +1,129 @@
+// Vigilant/proxy/shutdown.go
+// GRACEFUL SHUTDOWN: drain in-flight scans on SIGINT/SIGTERM
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_SHUTDOWN_GRACE = 15 * time.Second
+
+	// SHUTDOWN_ABORT_WINDOW is how long aborted requests get to write their
+	// 503 before the connections are closed.
+	SHUTDOWN_ABORT_WINDOW = 2 * time.Second
+)
+
+// draining is set once shutdown starts, so /readyz turns load balancers away.
+var draining atomic.Bool
+
+// serveCtx is the base context of every request on the scan server;
+// abortRequests cancels them all once the grace period is over.
+var serveCtx, abortRequests = context.WithCancel(context.Background())
+
+func baseContext(net.Listener) context.Context { return serveCtx }
+
+// waitIdle blocks until no shadow scan is running or ctx is done.
+func (t *shadowTracker) waitIdle(ctx context.Context) {
+	for len(t.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (a *auditWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.f.Sync()
+	return a.f.Close()
+}
+
+func (w *recordWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.f.Sync()
+	return w.f.Close()
+}
+
+// closeLogs flushes and closes the audit log, the recording and an access
+// log file.
+func closeLogs() {
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	if recorder != nil {
+		recorder.Close()
+	}
+	if accessLogFile != nil {
+		accessLogFile.Sync()
+		accessLogFile.Close()
+	}
+}
+
+// serveErr reports a listener failure; the ErrServerClosed every Serve
+// returns after Shutdown is not one.
+func serveErr(errc chan<- error, err error) {
+	if err != http.ErrServerClosed {
+		errc <- err
+	}
+}
+
+// serveUntilSignal returns after a clean shutdown, or exits on a listener
+// error. On SIGINT/SIGTERM it stops accepting connections and waits up to
+// grace for in-flight requests, daemon calls included, to finish. Requests
+// still running after that are aborted and answer 503; connections left
+// after SHUTDOWN_ABORT_WINDOW, or after a second signal, are cut off. The
+// health server shuts down last so probes see the drain, and the log files
+// are closed last of all.
+func serveUntilSignal(errc <-chan error, grace time.Duration, server, health *http.Server) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case s := <-sig:
+		log.Printf("[SHUTDOWN] %v: draining for up to %s", s, grace)
+	}
+	draining.Store(true)
+
+	// hard ends on a second signal, cutting both waits short.
+	hard, kill := context.WithCancel(context.Background())
+	defer kill()
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("[SHUTDOWN] %v again: closing remaining connections now", s)
+			kill()
+		case <-hard.Done():
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(hard, grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[SHUTDOWN_TIMEOUT] aborting requests still in flight with 503: %v", err)
+		abortRequests()
+		final, cancelFinal := context.WithTimeout(hard, SHUTDOWN_ABORT_WINDOW)
+		if err := server.Shutdown(final); err != nil {
+			log.Printf("[SHUTDOWN_TIMEOUT] closing connections still open: %v", err)
+			server.Close()
+		}
+		cancelFinal()
+	}
+	shadows.waitIdle(ctx)
+	health.Close()
+	closeLogs()
+	log.Printf("[SHUTDOWN] done")
+}
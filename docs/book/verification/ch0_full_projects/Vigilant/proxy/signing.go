@@ -0,0 +1,156 @@
+// Vigilant/proxy/signing.go
+// SIGNED VERDICTS: ed25519 envelope so downstream services can verify origin
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const SECRET_VERDICT_SIGNING_KEY = "verdict_signing_key"
+
+// VerdictEnvelope is the signed statement attached to every verdict. The
+// timestamp and nonce let clients reject replayed responses.
+type VerdictEnvelope struct {
+	Verdict     string `json:"verdict"`
+	Score       int    `json:"score"`
+	RequestHash string `json:"request_sha256"`
+	Timestamp   int64  `json:"ts"`
+	Nonce       string `json:"nonce"`
+	KeyID       string `json:"kid"`
+
+	// Simulated is set when the gateway didn't enforce the verdict.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+// verdictSigner is nil when no signing key is provisioned.
+var verdictSigner *VerdictSigner
+
+type VerdictSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+func NewVerdictSigner(key ed25519.PrivateKey) *VerdictSigner {
+	pub := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(pub)
+	return &VerdictSigner{key: key, keyID: hex.EncodeToString(sum[:8])}
+}
+
+func (s *VerdictSigner) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// parseSigningKey accepts a PKCS#8 PEM private key, or a raw 32-byte seed /
+// 64-byte private key encoded as hex or base64.
+func parseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("PEM key is %T, want ed25519", k)
+		}
+		return priv, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		if raw, err = base64.StdEncoding.DecodeString(text); err != nil {
+			return nil, errors.New("key is neither PEM, hex nor base64")
+		}
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, want %d (seed) or %d", len(raw), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// loadVerdictSigner reads the signing key from the secret store. A missing key
+// disables signing; a present but unusable key is an error.
+func loadVerdictSigner(store *SecretStore) (*VerdictSigner, error) {
+	if store == nil {
+		return nil, nil
+	}
+	data, err := store.Get(SECRET_VERDICT_SIGNING_KEY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("SIGNING_KEY_INVALID: %v", err)
+	}
+	return NewVerdictSigner(key), nil
+}
+
+// Sign stamps the envelope and returns the exact bytes signed plus the
+// signature. Clients must verify against the envelope bytes as received.
+func (s *VerdictSigner) Sign(res ScanResult, body []byte) (envelope, sig []byte, err error) {
+	return s.SignDigest(res, sha256.Sum256(body))
+}
+
+// SignDigest is Sign for a body that is known only by its SHA-256.
+func (s *VerdictSigner) SignDigest(res ScanResult, sum [sha256.Size]byte) (envelope, sig []byte, err error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	envelope, err = json.Marshal(VerdictEnvelope{
+		Verdict:     res.Verdict,
+		Score:       res.Score,
+		RequestHash: hex.EncodeToString(sum[:]),
+		Timestamp:   time.Now().Unix(),
+		Nonce:       hex.EncodeToString(nonce),
+		KeyID:       s.keyID,
+		Simulated:   res.Simulated,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return envelope, ed25519.Sign(s.key, envelope), nil
+}
+
+// signVerdict attaches X-Vigilant-Verdict (base64url envelope) and
+// X-Vigilant-Signature (base64url ed25519 signature). Must run before
+// WriteHeader.
+func signVerdict(w http.ResponseWriter, res ScanResult, body []byte) {
+	signVerdictDigest(w, res, sha256.Sum256(body))
+}
+
+func signVerdictDigest(w http.ResponseWriter, res ScanResult, sum [sha256.Size]byte) {
+	if verdictSigner == nil {
+		return
+	}
+	envelope, sig, err := verdictSigner.SignDigest(res, sum)
+	if err != nil {
+		// An unsigned response fails client verification, which is the safe
+		// outcome; the verdict itself is still enforced.
+		log.Printf("[SIGNING_FAIL] %v", err)
+		return
+	}
+	w.Header().Set("X-Vigilant-Verdict", base64.RawURLEncoding.EncodeToString(envelope))
+	w.Header().Set("X-Vigilant-Signature", base64.RawURLEncoding.EncodeToString(sig))
+}
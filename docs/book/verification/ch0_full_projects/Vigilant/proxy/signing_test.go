@@ -0,0 +1,83 @@
+// Vigilant/proxy/signing_test.go
+// SIGNED VERDICTS: envelopes verify as clients check them; any edit breaks them
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// signedHeaders signs res for body the way a handler does and returns the
+// decoded envelope and signature headers.
+func signedHeaders(t *testing.T, res ScanResult, body []byte) (ed25519.PublicKey, []byte, []byte) {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	saved := verdictSigner
+	verdictSigner = NewVerdictSigner(priv)
+	t.Cleanup(func() { verdictSigner = saved })
+
+	w := httptest.NewRecorder()
+	signVerdict(w, res, body)
+	envelope, err := base64.RawURLEncoding.DecodeString(w.Header().Get("X-Vigilant-Verdict"))
+	if err != nil {
+		t.Fatalf("X-Vigilant-Verdict: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(w.Header().Get("X-Vigilant-Signature"))
+	if err != nil {
+		t.Fatalf("X-Vigilant-Signature: %v", err)
+	}
+	return verdictSigner.PublicKey(), envelope, sig
+}
+
+func TestVerdictEnvelopeVerifies(t *testing.T) {
+	body := []byte(`{"ssn": "078-05-1120"}`)
+	pub, envelope, sig := signedHeaders(t, ScanResult{Verdict: VERDICT_BLOCK, Score: 200}, body)
+	if !ed25519.Verify(pub, envelope, sig) {
+		t.Fatal("signature doesn't verify over the envelope as received")
+	}
+	var env VerdictEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	if env.Verdict != VERDICT_BLOCK || env.Score != 200 || env.RequestHash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("envelope = %+v, want the block, its score and the body's digest", env)
+	}
+	if env.Nonce == "" || env.Timestamp == 0 || env.KeyID == "" {
+		t.Fatalf("envelope = %+v, want nonce, ts and kid set", env)
+	}
+}
+
+func TestVerdictEnvelopeRejectsEdits(t *testing.T) {
+	body := []byte("document")
+	pub, envelope, sig := signedHeaders(t, ScanResult{Verdict: VERDICT_BLOCK, Score: 200}, body)
+	var env VerdictEnvelope
+	json.Unmarshal(envelope, &env)
+	other := sha256.Sum256([]byte("another document"))
+
+	edits := map[string]func(*VerdictEnvelope){
+		"score":          func(e *VerdictEnvelope) { e.Score = 0 },
+		"verdict":        func(e *VerdictEnvelope) { e.Verdict = VERDICT_PASS },
+		"request_sha256": func(e *VerdictEnvelope) { e.RequestHash = hex.EncodeToString(other[:]) },
+		"nonce":          func(e *VerdictEnvelope) { e.Nonce = "00" },
+	}
+	for field, edit := range edits {
+		e := env
+		edit(&e)
+		forged, _ := json.Marshal(e)
+		if bytes.Equal(forged, envelope) {
+			t.Fatalf("%s: edit left the envelope unchanged", field)
+		}
+		if ed25519.Verify(pub, forged, sig) {
+			t.Errorf("signature still verifies with %s changed", field)
+		}
+	}
+}
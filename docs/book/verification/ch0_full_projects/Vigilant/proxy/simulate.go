@@ -0,0 +1,68 @@
+// Vigilant/proxy/simulate.go
+// SIMULATE MODE: score everything, enforce nothing, say so on every request
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	MODE_HEADER      = "X-Vigilant-Mode"
+	MODE_SIMULATE    = "simulate"
+	SIMULATED_HEADER = "X-Vigilant-Simulated"
+
+	SIMULATED_VERDICT_HEADER = "X-Vigilant-Simulated-Verdict"
+	SIMULATED_SCORE_HEADER   = "X-Vigilant-Simulated-Score"
+)
+
+// SimulateConfig runs the full scan but answers 200 with the would-be
+// verdict in headers, for trying a new risk matrix against live traffic.
+// Enabled simulates every request; AllowHeader lets a client ask for it per
+// request with "X-Vigilant-Mode: simulate". The header is ignored otherwise,
+// so a client can't opt itself out of enforcement.
+type SimulateConfig struct {
+	Enabled     bool `json:"enabled"`
+	AllowHeader bool `json:"allow_header"`
+}
+
+// simulating reports whether r's verdict is reported instead of enforced.
+func simulating(r *http.Request, cfg *Config) bool {
+	if cfg.Simulate.Enabled {
+		return true
+	}
+	if !strings.EqualFold(r.Header.Get(MODE_HEADER), MODE_SIMULATE) {
+		return false
+	}
+	if !cfg.Simulate.AllowHeader {
+		log.Printf("[SIMULATE_REFUSED] %s asked for %s: %s without simulate.allow_header; enforcing", r.URL.Path, MODE_HEADER, MODE_SIMULATE)
+		return false
+	}
+	return true
+}
+
+// logSimulateMode announces a switch into or out of simulate mode.
+func logSimulateMode(cfg *Config) {
+	if cfg.Simulate.Enabled {
+		log.Printf("[SIMULATE_MODE] ON: verdicts are reported, NOT enforced")
+	} else {
+		log.Printf("[SIMULATE_MODE] OFF: verdicts are enforced")
+	}
+}
+
+// writeSimulated answers a simulated request. Every one is logged, so a
+// deployment left in simulate mode can't pass for one that enforces.
+func writeSimulated(w http.ResponseWriter, r *http.Request, res ScanResult) {
+	exposeScore(w, r, &res)
+	log.Printf("[SIMULATE] id=%s %s would be %s (score %d, threshold %d); not enforced", w.Header().Get("X-Request-ID"), r.URL.Path, res.Verdict, res.Score, res.Threshold)
+	w.Header().Set(SIMULATED_HEADER, "true")
+	w.Header().Set(SIMULATED_VERDICT_HEADER, res.Verdict)
+	w.Header().Set(SIMULATED_SCORE_HEADER, strconv.Itoa(res.Score))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"status": "SIMULATED", "verdict": res.Verdict, "score": res.Score})
+}
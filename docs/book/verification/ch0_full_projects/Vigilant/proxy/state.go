@@ -0,0 +1,128 @@
+// Vigilant/proxy/state.go
+// GATEWAY STATE: redacted config, recent verdicts and daemon health
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const DAEMON_PROBE_TIMEOUT = 500 * time.Millisecond
+
+// secretField matches config keys whose values must never leave the process.
+var secretField = regexp.MustCompile(`(?i)(key|secret|token|passphrase|password|prefix)`)
+
+const REDACTED = "[REDACTED]"
+
+type DaemonStatus struct {
+	Name      string  `json:"name"`
+	Socket    string  `json:"socket"`
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// GatewayState is the snapshot served on /debug/state and captured in
+// support bundles.
+type GatewayState struct {
+	Version  string          `json:"version"`
+	Time     time.Time       `json:"time"`
+	Config   any             `json:"config"`
+	Recent   []VerdictRecord `json:"recent_verdicts"`
+	Daemons  []DaemonStatus  `json:"daemons"`
+	FDs      FDStats         `json:"fds"`
+	Shadows  []ShadowStats   `json:"shadows"`
+	Pools    []PoolStats     `json:"daemon_pools"`
+	Breakers []BreakerStats  `json:"breakers"`
+	Cache    CacheStats      `json:"result_cache"`
+	Limiter  RateLimitStats  `json:"rate_limit"`
+}
+
+// daemonSockets lists the scanning daemons the gateway fans out to, as the
+// live config has them.
+func daemonSockets() []daemonAddr {
+	if cfg := currentConfig(); cfg != nil {
+		return cfg.scanners()
+	}
+	return (&Config{}).scanners()
+}
+
+// probeDaemon checks that a daemon socket accepts connections.
+func probeDaemon(name, sock string) DaemonStatus {
+	st := DaemonStatus{Name: name, Socket: sock}
+	start := time.Now()
+	conn, err := dialDaemon(context.Background(), sock, DAEMON_PROBE_TIMEOUT)
+	st.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	conn.Close()
+	st.Reachable = true
+	return st
+}
+
+func probeDaemons() []DaemonStatus {
+	var out []DaemonStatus
+	for _, d := range daemonSockets() {
+		out = append(out, probeDaemon(d.Name, d.Socket))
+	}
+	return out
+}
+
+// redactConfig returns a JSON-shaped copy of cfg with every value under a
+// secret-looking key replaced, so new secret fields are covered by default.
+func redactConfig(cfg Config) any {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return REDACTED
+	}
+	var v any
+	json.Unmarshal(data, &v)
+	return redactValue(v)
+}
+
+func redactValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if secretField.MatchString(k) {
+				t[k] = REDACTED
+			} else {
+				t[k] = redactValue(val)
+			}
+		}
+	case []any:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+	}
+	return v
+}
+
+func currentState() GatewayState {
+	return GatewayState{
+		Version:  GATEWAY_VERSION,
+		Time:     time.Now().UTC(),
+		Config:   redactConfig(*currentConfig()),
+		Recent:   recentVerdicts.Snapshot(),
+		Daemons:  probeDaemons(),
+		FDs:      fds.Stats(),
+		Shadows:  shadows.Snapshot(),
+		Pools:    daemonPools.Snapshot(),
+		Breakers: breakers.Snapshot(),
+		Cache:    scanCache.Snapshot(),
+		Limiter:  limiter.Stats(),
+	}
+}
+
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentState())
+}
@@ -0,0 +1,422 @@
+// Vigilant/proxy/stream.go
+// STREAMING SCANS: large bodies piped to every daemon without buffering
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_STREAM_MAX_BYTES = 1 << 30
+
+var errStreamUnsupported = errors.New("STREAM_UNSUPPORTED")
+
+// StreamConfig enables POST /stream. The body is read once and copied into
+// every daemon as it arrives, so it is never held in memory whole; the
+// price is that nothing needing the whole body can run (see streamable).
+type StreamConfig struct {
+	Enabled      bool  `json:"enabled"`
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+func (s StreamConfig) maxBodyBytes() int64 {
+	if s.MaxBodyBytes <= 0 {
+		return DEFAULT_STREAM_MAX_BYTES
+	}
+	return s.MaxBodyBytes
+}
+
+func (s StreamConfig) validate() []ConfigProblem {
+	if s.MaxBodyBytes < 0 {
+		return []ConfigProblem{{Field: "stream.max_body_bytes", Message: fmt.Sprintf("must be >= 0, got %d", s.MaxBodyBytes)}}
+	}
+	return nil
+}
+
+// streamDaemons lists every daemon the scorer chain may call, once each.
+func (c *Config) streamDaemons() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, st := range c.ScorerChain.stages(c.scannerNames()) {
+		for _, n := range st.Daemons {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+// streamable checks the config allows scanning without the whole body:
+// no scan_field, and only adapters that can be written as a prefix.
+func (c *Config) streamable(names []string) error {
+	if c.ScanField.compiled != nil {
+		return fmt.Errorf("%w: scan_field needs the whole body", errStreamUnsupported)
+	}
+	for _, n := range names {
+		switch c.sendAdapter(n).Format {
+		case "", SEND_RAW, SEND_PREFIX:
+		default:
+			return fmt.Errorf("%w: daemon %s uses send format %q", errStreamUnsupported, n, c.sendAdapter(n).Format)
+		}
+	}
+	return nil
+}
+
+type streamCall struct {
+	name, sock string
+	adapter    SendAdapter
+	pool       *PoolConfig
+	breaker    *circuitBreaker
+	span       *Span
+	start      time.Time
+	pr         *io.PipeReader
+	pw         *io.PipeWriter
+	findings   []Finding
+	err        error
+
+	// sent digests the prefix and body the daemon was sent, when recording.
+	sent hash.Hash
+}
+
+// prefix is what the daemon is sent ahead of the body.
+func (c *streamCall) prefix() string {
+	if c.adapter.Format == SEND_PREFIX {
+		return c.adapter.Prefix
+	}
+	return ""
+}
+
+var errLengthRequired = errors.New("LENGTH_REQUIRED")
+
+// streamCalls builds one call per daemon, each let through its circuit
+// breaker. allow takes a half-open breaker's probe slot, so every reason to
+// refuse the request is checked before the first allow, and a fail_closed
+// refusal hands back the probes already taken. Under fail_open,
+// circuit-open daemons are left out.
+func (c *Config) streamCalls(names []string, contentLength int64) ([]*streamCall, error) {
+	calls := make([]*streamCall, 0, len(names))
+	for _, n := range names {
+		sc := &streamCall{name: n, sock: c.daemonSocket(n), adapter: c.sendAdapter(n), pool: c.daemonPool(n)}
+		if sc.pool != nil && contentLength < 0 {
+			return nil, errLengthRequired
+		}
+		calls = append(calls, sc)
+	}
+	if c.Breaker.Failures == 0 {
+		return calls, nil
+	}
+	allowed := calls[:0]
+	for _, sc := range calls {
+		sc.breaker = breakers.get(sc.sock)
+		if sc.breaker.allow(c.Breaker) {
+			allowed = append(allowed, sc)
+			continue
+		}
+		if !c.Breaker.failOpen() {
+			for _, a := range allowed {
+				a.breaker.abandon()
+			}
+			return nil, errCircuitOpen
+		}
+	}
+	return allowed, nil
+}
+
+// streamToDaemon writes the adapter prefix and then src to one daemon. A
+// pooled daemon gets a single frame, so its length must be known up front.
+// Only getting a connection is retried; once the body has started flowing
+// it can't be replayed.
+func streamToDaemon(ctx context.Context, retry RetryConfig, c *streamCall, length int64) ([]Finding, error) {
+	prefix := c.prefix()
+	src := io.MultiReader(strings.NewReader(prefix), c.pr)
+
+	if c.pool == nil {
+		var conn net.Conn
+		err := retry.do(ctx, c.sock, func() (err error) {
+			conn, err = dialDaemon(ctx, c.sock, 1*time.Second)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		defer watchConn(ctx, conn)()
+		if _, err := io.Copy(conn, src); err != nil {
+			return nil, err
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		var findings []Finding
+		if err := json.NewDecoder(conn).Decode(&findings); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return findings, nil
+	}
+
+	p := daemonPools.get(c.sock, *c.pool)
+	var pc *pooledConn
+	err := retry.do(ctx, c.sock, func() (err error) {
+		pc, _, err = p.acquire(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	stop := watchConn(ctx, pc)
+	n := int64(len(prefix)) + length
+	err = writeFrameHeader(pc, n)
+	if err == nil {
+		_, err = io.CopyN(pc, src, n)
+	}
+	var resp []byte
+	if err == nil {
+		resp, err = readFrame(pc)
+	}
+	p.release(pc, rearm(pc, stop, err))
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	json.Unmarshal(resp, &findings)
+	return findings, nil
+}
+
+// bodyReader remembers the first read error, so a failed body can be told
+// apart from a daemon that stopped reading.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// fanOut copies the body to every daemon's pipe. A daemon that stops
+// reading has its pipe dropped while the others keep getting the body, so
+// one failed daemon doesn't fail the rest; only a body read error ends the
+// copy.
+type fanOut struct {
+	writers []io.Writer
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	live := f.writers[:0]
+	for _, w := range f.writers {
+		if _, err := w.Write(p); err == nil {
+			live = append(live, w)
+		}
+	}
+	f.writers = live
+	return len(p), nil
+}
+
+// streamHandler scans a body of any size in one pass. The body is tee'd into
+// a SHA-256 digest and the JSON depth check on its way to one pipe per
+// daemon, and the scorer chain then decides on the findings as usual.
+// Shadow daemons get no copy, and a score in the redact band blocks, since
+// a streamed body can't be masked.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if !cfg.Stream.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	names := cfg.streamDaemons()
+	if err := cfg.streamable(names); err != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	limit := cfg.Stream.maxBodyBytes()
+	if r.ContentLength > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "{\"error\": \"Body exceeds %d bytes\"}", limit)
+		return
+	}
+
+	calls, err := cfg.streamCalls(names, r.ContentLength)
+	if errors.Is(err, errLengthRequired) {
+		w.WriteHeader(http.StatusLengthRequired)
+		w.Write([]byte("{\"error\": \"Pooled daemons need a Content-Length to stream\"}"))
+		return
+	}
+	// Under fail_closed a circuit-open daemon blocks the body. It is still
+	// read, for the digest the block is signed and audited with.
+	circuitOpen := errors.Is(err, errCircuitOpen)
+	if !circuitOpen && (err != nil || len(calls) == 0) {
+		exposeScore(w, r, nil)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// request_timeout_ms starts once the body is in: uploading a large body
+	// may take longer than any daemon should need to answer.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	digest := sha256.New()
+	depth := &depthScanner{max: cfg.maxJSONDepth()}
+	writers := make([]io.Writer, len(calls))
+	taps := []io.Writer{digest, depth}
+	for i, c := range calls {
+		if recorder != nil {
+			c.sent = sha256.New()
+			io.WriteString(c.sent, c.prefix())
+			taps = append(taps, c.sent)
+		}
+		_, c.span = startSpan(r.Context(), "scan "+c.name, SPAN_KIND_CLIENT)
+		c.pr, c.pw = io.Pipe()
+		writers[i] = c.pw
+		c.start = time.Now()
+		wg.Add(1)
+		go func(c *streamCall) {
+			defer wg.Done()
+			c.findings, c.err = streamToDaemon(ctx, cfg.Retry, c, r.ContentLength)
+			// Unblock the copy below if this daemon stopped reading early.
+			c.pr.CloseWithError(c.err)
+			traceDaemon(c.span, c.sock, c.findings, c.err)
+		}(c)
+	}
+
+	body := &bodyReader{r: io.TeeReader(http.MaxBytesReader(w, r.Body, limit), io.MultiWriter(taps...))}
+	length, copyErr := io.Copy(&fanOut{writers: writers}, body)
+	for _, c := range calls {
+		c.pw.CloseWithError(copyErr)
+	}
+	timer := time.AfterFunc(cfg.requestTimeout(), func() { cancel(context.DeadlineExceeded) })
+	wg.Wait()
+	timer.Stop()
+
+	// A body that couldn't be read fails every daemon stream too; that is
+	// the client's fault, so the breakers and metrics only count daemon
+	// failures.
+	if body.err != nil {
+		for _, c := range calls {
+			if c.breaker != nil {
+				c.breaker.abandon()
+			}
+		}
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &tooLarge):
+		log.Printf("[BODY_TOO_LARGE] %s exceeds %d bytes", r.URL.Path, limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "{\"error\": \"Body exceeds %d bytes\"}", limit)
+		return
+	case errors.Is(body.err, errJSONTooDeep):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": body.err.Error()})
+		return
+	case body.err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	byName := make(map[string][]Finding)
+	var answers []daemonFindings
+	failed := false
+	for _, c := range calls {
+		if c.breaker != nil {
+			c.breaker.record(cfg.Breaker, c.err)
+		}
+		metrics.observeDaemon(c.sock, c.start, c.err)
+		noteDaemon(r.Context(), c.sock, c.start, c.err)
+		if c.err != nil {
+			failed = true
+			continue
+		}
+		byName[c.name] = c.adapter.mapFindings(c.findings)
+		answers = append(answers, daemonFindings{c.name, byName[c.name]})
+	}
+	if failed && len(answers) > 0 && cfg.Quorum.MinResponses > 0 && cfg.Quorum.quorumMet(len(answers), len(calls)) {
+		log.Printf("[QUORUM] %d of %d daemons answered, quorum met", len(answers), len(calls))
+		failed = false
+	}
+	if failed {
+		exposeScore(w, r, nil)
+		if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			log.Printf("[SCAN_TIMEOUT] %s: daemons didn't answer within %s", r.URL.Path, cfg.requestTimeout())
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// The body digest is only known now, so a policy override is confirmed
+	// here rather than before the daemons start.
+	var sum [sha256.Size]byte
+	digest.Sum(sum[:0])
+	r = confirmOverride(r, sum)
+
+	// Every daemon has already scanned the whole body, so the stages only
+	// replay their decisions; stages whose daemons were all circuit-open
+	// fail as they would in the buffered path.
+	rules := rulesFrom(r.Context(), cfg)
+	var res ScanResult
+	switch {
+	case circuitOpen:
+		log.Printf("[BREAKER_BLOCK] Circuit open, blocking unscanned document")
+		res.Verdict, err = VERDICT_BLOCK, nil
+	case cfg.Quorum.votes():
+		res = decideQuorum(rules, answers)
+	default:
+		res, err = decideChain(rules, replayStages(byName))
+	}
+	if err != nil {
+		exposeScore(w, r, nil)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	res.Threshold = rules.block
+	if cfg.inRedactBand(res) {
+		log.Printf("[REDACT_FAIL] Score: %d, blocking instead: a streamed body can't be masked", res.Score)
+		res.Verdict = VERDICT_BLOCK
+	}
+
+	if !circuitOpen {
+		recordStream(withRecording(r.Context(), sum), calls, byName, rules, res)
+	}
+
+	id := w.Header().Get("X-Request-ID")
+	res.Simulated = simulating(r, cfg)
+	signVerdictDigest(w, res, sum)
+	recentVerdicts.Add(id, r.URL.Path, res)
+	auditStreamed(r, id, r.URL.Path, sum, int(length), res)
+	metrics.countVerdict("/stream", res)
+	noteVerdict(r.Context(), res)
+	writeVerdict(w, r, res)
+}
+
+// recordStream records each daemon that answered, then the verdict.
+func recordStream(ctx context.Context, calls []*streamCall, byName map[string][]Finding, rules *scoringRules, res ScanResult) {
+	for _, c := range calls {
+		if c.err != nil || c.sent == nil {
+			continue
+		}
+		var sent [sha256.Size]byte
+		c.sent.Sum(sent[:0])
+		recordStreamedDaemon(ctx, c.name, c.sock, sent, byName[c.name])
+	}
+	recordVerdict(ctx, rules, res)
+}
@@ -0,0 +1,127 @@
+// Vigilant/proxy/stream_test.go
+// STREAMING SCANS: breaker probes are never stranded by a refused request,
+// and a quorum decides a stream the way it decides a buffered scan
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setBreaker opens sock's circuit openedAgo in the past. Past the cooldown,
+// the next allow takes the half-open probe.
+func setBreaker(t *testing.T, sock string, openedAgo time.Duration) *circuitBreaker {
+	t.Helper()
+	b := &circuitBreaker{stats: BreakerStats{Socket: sock, State: BREAKER_OPEN}, openedAt: time.Now().Add(-openedAgo)}
+	breakers.mu.Lock()
+	breakers.breakers[sock] = b
+	breakers.mu.Unlock()
+	t.Cleanup(func() {
+		breakers.mu.Lock()
+		delete(breakers.breakers, sock)
+		breakers.mu.Unlock()
+	})
+	return b
+}
+
+func TestStreamCallsFailClosedReleasesProbe(t *testing.T) {
+	cfg := &Config{Breaker: BreakerConfig{Failures: 1, CooldownMs: 60000, OnOpen: ON_OPEN_FAIL_CLOSED}}
+	names := cfg.scannerNames()
+	probe := setBreaker(t, cfg.daemonSocket(names[0]), time.Hour)
+	setBreaker(t, cfg.daemonSocket(names[1]), 0)
+
+	if _, err := cfg.streamCalls(names, 10); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("streamCalls error = %v, want %v", err, errCircuitOpen)
+	}
+	if probe.probing {
+		t.Fatal("half-open breaker still holds the probe of a refused request")
+	}
+	if !probe.allow(cfg.Breaker) {
+		t.Fatal("the next caller can't probe the half-open daemon")
+	}
+}
+
+func TestStreamCallsLengthRequiredTakesNoProbe(t *testing.T) {
+	cfg := &Config{
+		Breaker: BreakerConfig{Failures: 1, CooldownMs: 60000},
+		Daemons: []DaemonConfig{{Name: DAEMON_ANALYST, Pool: &PoolConfig{MaxIdle: 1}}},
+	}
+	names := cfg.scannerNames()
+	probe := setBreaker(t, cfg.daemonSocket(names[0]), time.Hour)
+
+	if _, err := cfg.streamCalls(names, -1); !errors.Is(err, errLengthRequired) {
+		t.Fatalf("streamCalls error = %v, want %v", err, errLengthRequired)
+	}
+	if probe.probing || probe.stats.State != BREAKER_OPEN {
+		t.Fatalf("breaker was touched by a request refused for its length: state %s, probing %v", probe.stats.State, probe.probing)
+	}
+}
+
+// fakeDaemon answers every scan on a new socket with findings.
+func fakeDaemon(t *testing.T, findings string) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "d.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, conn)
+			conn.Write([]byte(findings))
+			conn.Close()
+		}
+	}()
+	return sock
+}
+
+func TestStreamQuorumToleratesFailedDaemon(t *testing.T) {
+	saved := paths
+	t.Cleanup(func() { paths = saved })
+	paths.ShieldSock = fakeDaemon(t, `[{"type": "ID_SSN"}]`)
+	paths.AnalystSock = fakeDaemon(t, `[]`)
+	down := filepath.Join(t.TempDir(), "down.sock")
+
+	cfg, problems := parseConfig([]byte(`{
+		"policies": [{"type": "ID_SSN", "score": 100}],
+		"thresholds": {"block": 90, "redact": 40},
+		"expose_findings": true,
+		"stream": {"enabled": true},
+		"quorum": {"min_responses": 2},
+		"daemons": [{"name": "extra", "socket": "` + down + `"}]
+	}`))
+	if len(problems) > 0 {
+		t.Fatalf("config problems: %v", problems)
+	}
+	savedCfg := currentConfig()
+	liveConfig.Store(&cfg)
+	t.Cleanup(func() { liveConfig.Store(savedCfg) })
+
+	scan := func(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		body := "ssn 078-05-1120 " + path
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+	buffered := scan(handler, "/")
+	streamed := scan(streamHandler, "/stream")
+	for _, res := range []*httptest.ResponseRecorder{buffered, streamed} {
+		if res.Code != http.StatusForbidden || res.Header().Get(SCORE_HEADER) != "100" {
+			t.Fatalf("status %d, score %q; want 403 with score 100 from the two daemons that answered",
+				res.Code, res.Header().Get(SCORE_HEADER))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Vigilant/proxy/tracing.go
+// DISTRIBUTED TRACING: W3C trace context + OTLP/HTTP JSON export
+//
+// Tracing is a no-op unless an OTLP endpoint is configured through the
+// standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT / OTEL_EXPORTER_OTLP_ENDPOINT
+// variables. All Span methods are safe on a nil *Span.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+
+	TRACE_QUEUE_SIZE     = 2048
+	TRACE_BATCH_SIZE     = 256
+	TRACE_FLUSH_INTERVAL = 2 * time.Second
+)
+
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	mu       sync.Mutex
+	attrs    map[string]string
+	errMsg   string
+	ended    bool
+}
+
+type spanKey struct{}
+
+// tracer is nil when no exporter is configured.
+var tracer *otlpExporter
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx (or a new trace) and returns a
+// context carrying it. Without an exporter it returns ctx and a nil span.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startServerSpan continues the caller's trace when a valid traceparent
+// header is present.
+func startServerSpan(r *http.Request, name string) (context.Context, *Span) {
+	ctx := r.Context()
+	if tracer == nil {
+		return ctx, nil
+	}
+	if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, spanKey{}, remote)
+	}
+	return startSpan(ctx, name, SPAN_KIND_SERVER)
+}
+
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+// Traceparent renders the W3C header value identifying this span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceparent returns a remote parent placeholder for a W3C header.
+func parseTraceparent(h string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, false
+	}
+	s := &Span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	return s, true
+}
+
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+}
+
+// initTracing enables export when an OTLP endpoint is configured.
+func initTracing() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "naab-vigilant"
+	}
+	tracer = &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		queue:    make(chan *Span, TRACE_QUEUE_SIZE),
+	}
+	go tracer.run()
+	log.Printf("[TRACING] Exporting spans to %s as %q", endpoint, service)
+}
+
+// enqueue never blocks the request path; spans are dropped when the
+// exporter falls behind.
+func (e *otlpExporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(TRACE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < TRACE_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.export(batch)
+		batch = nil
+	}
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func otlpAttrs(m map[string]string) []otlpAttr {
+	out := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		out = append(out, otlpAttr{Key: k, Value: map[string]string{"stringValue": v}})
+	}
+	return out
+}
+
+func (e *otlpExporter) export(batch []*Span) {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+
+	payload, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttrs(map[string]string{"service.name": e.service})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "vigilant-gateway", "version": GATEWAY_VERSION},
+				"spans": spans,
+			}},
+		}},
+	})
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("[TRACE_EXPORT_FAIL] %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[TRACE_EXPORT_FAIL] %s answered %s", e.endpoint, resp.Status)
+	}
+}
+
+// withTracing opens the server span for a request and propagates its
+// context to the handler.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := startServerSpan(r, r.Method+" "+r.URL.Path)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.route", r.URL.Path)
+		span.SetAttr("vigilant.request_id", w.Header().Get("X-Request-ID"))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", strconv.Itoa(rec.status))
+	})
+}
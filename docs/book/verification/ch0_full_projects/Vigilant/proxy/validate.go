@@ -0,0 +1,79 @@
+// Vigilant/proxy/validate.go
+// `naab-vigilant validate [--json] [config.json|policy.d/]`: CI gate for risk matrices
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type validateReport struct {
+	File     string          `json:"file"`
+	Valid    bool            `json:"valid"`
+	Problems []ConfigProblem `json:"problems"`
+}
+
+// runValidate parses and validates a config exactly as the gateway would at
+// startup, without starting a server. Exit code 0 = valid, 1 = problems
+// found, 2 = usage or read error.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "emit a machine-readable report")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s validate [--json] [config.json|policy.d/]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// Allow flags after the path as well: `validate config.json --json`.
+	path := paths.Policy
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() > 0 {
+			fs.Usage()
+			return 2
+		}
+	}
+
+	_, problems, err := readConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CONFIG_LOAD_FAIL: %v\n", err)
+		return 2
+	}
+	report := validateReport{File: path, Valid: len(problems) == 0, Problems: problems}
+	if report.Problems == nil {
+		report.Problems = []ConfigProblem{}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(report)
+	} else {
+		printValidateReport(os.Stdout, report)
+	}
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+func printValidateReport(w io.Writer, report validateReport) {
+	if report.Valid {
+		fmt.Fprintf(w, "%s: OK\n", report.File)
+		return
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintf(w, "%s: %v\n", report.File, p)
+	}
+	fmt.Fprintf(w, "%s: %d problem(s)\n", report.File, len(report.Problems))
+}
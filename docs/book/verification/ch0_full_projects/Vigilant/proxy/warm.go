@@ -0,0 +1,101 @@
+// Vigilant/proxy/warm.go
+// WARM START: exercise every daemon before the first real request
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WARM_OFF        = "off"
+	WARM_FOREGROUND = "foreground"
+	WARM_BACKGROUND = "background"
+
+	DEFAULT_WARM_TIMEOUT = 10 * time.Second
+	WARM_RETRY_INTERVAL  = 200 * time.Millisecond
+)
+
+// WarmConfig controls the startup warm phase. In the foreground the listener
+// opens only after warming; in the background it opens at once and scan
+// requests get 503 until warming is done.
+type WarmConfig struct {
+	Mode      string `json:"mode"`
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+func (w WarmConfig) timeout() time.Duration {
+	if w.TimeoutMs <= 0 {
+		return DEFAULT_WARM_TIMEOUT
+	}
+	return time.Duration(w.TimeoutMs) * time.Millisecond
+}
+
+// warmed is false only while a background warm phase is running.
+var warmed atomic.Bool
+
+// warmDaemon sends an empty document through the real scan path until the
+// daemon answers or the deadline passes.
+func warmDaemon(name, sock string, deadline time.Time) {
+	start := time.Now()
+	for {
+		_, err := callDaemon(context.Background(), RetryConfig{}, sock, currentConfig().daemonPool(name), nil)
+		if err == nil {
+			log.Printf("[WARM] %s ready in %s", name, time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if time.Now().Add(WARM_RETRY_INTERVAL).After(deadline) {
+			log.Printf("[WARM_FAIL] %s not ready after %s: %v", name, time.Since(start).Round(time.Millisecond), err)
+			return
+		}
+		time.Sleep(WARM_RETRY_INTERVAL)
+	}
+}
+
+func warmDaemons(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	for _, d := range daemonSockets() {
+		wg.Add(1)
+		go func(name, sock string) {
+			defer wg.Done()
+			warmDaemon(name, sock, deadline)
+		}(d.Name, d.Socket)
+	}
+	wg.Wait()
+}
+
+// startWarm runs the configured warm phase. It returns once the listener may
+// open: after warming in the foreground, immediately otherwise.
+func startWarm(cfg WarmConfig) {
+	switch cfg.Mode {
+	case WARM_FOREGROUND:
+		warmDaemons(cfg.timeout())
+		warmed.Store(true)
+	case WARM_BACKGROUND:
+		go func() {
+			warmDaemons(cfg.timeout())
+			warmed.Store(true)
+			log.Printf("[WARM] Background warm phase done, accepting scans")
+		}()
+	default:
+		warmed.Store(true)
+	}
+}
+
+// withWarmGate answers 503 while a background warm phase is still running.
+func withWarmGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !warmed.Load() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
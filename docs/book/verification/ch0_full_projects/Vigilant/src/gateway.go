@@ -1,45 +1,566 @@
 package main
 import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
     "net/http"
     "io"
     "net"
+    "math/rand"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
     "sync/atomic"
+    "syscall"
     "log"
     "time"
 )
 
-var shards = []string{
-    "/data/data/com.termux/files/usr/tmp/v_brain.sock",
+// Shard is one brain socket. Weight is its share of traffic under the
+// weighted strategy; a zero weight drains the shard.
+type Shard struct {
+    Sock   string
+    Weight int
 }
-var counter uint64
 
-func handle(w http.ResponseWriter, r *http.Request) {
-    idx := atomic.AddUint64(&counter, 1) % uint64(len(shards))
-    sock := shards[idx]
+var shards = []Shard{
+    {Sock: "/data/data/com.termux/files/usr/tmp/v_brain.sock", Weight: 1},
+}
 
-    // Dial with a short timeout to prevent hangs
-    conn, err := net.DialTimeout("unix", sock, 2*time.Second)
+// Bodies larger than this get 413 before any shard is dialed; override
+// with VIGILANT_MAX_BODY_BYTES.
+var maxBodyBytes int64 = 10 << 20
+
+const DEFAULT_SHUTDOWN_GRACE = 15 * time.Second
+
+// Requests still running when the grace period ends are cancelled, and get
+// this long to send their 503 before their connections are closed.
+const SHUTDOWN_ABORT_WINDOW = 2 * time.Second
+
+// A brain round-trip that takes longer than this gets 504 and its socket is
+// torn down; override with VIGILANT_REQUEST_TIMEOUT.
+var requestTimeout = 10 * time.Second
+
+const (
+    DEFAULT_SHARD_EJECT_AFTER = 3
+    SHARD_PROBE_INTERVAL      = 5 * time.Second
+    SHARD_PROBE_TIMEOUT       = 1 * time.Second
+)
+
+// shardHealth ejects a shard after ejectAfter consecutive dial failures.
+// An ejected shard gets no traffic until a background probe reaches it.
+type shardHealth struct {
+    mu         sync.Mutex
+    ejectAfter int
+    failures   map[string]int
+    down       map[string]bool
+}
+
+func newShardHealth(ejectAfter int) *shardHealth {
+    return &shardHealth{ejectAfter: ejectAfter, failures: make(map[string]int), down: make(map[string]bool)}
+}
+
+var health = newShardHealth(DEFAULT_SHARD_EJECT_AFTER)
+
+// up returns the shards currently taking traffic, as one consistent view.
+func (h *shardHealth) up(all []Shard) []Shard {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    var out []Shard
+    for _, s := range all {
+        if !h.down[s.Sock] {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+// report records the outcome of a dial to sock.
+func (h *shardHealth) report(sock string, err error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if err == nil {
+        h.failures[sock] = 0
+        return
+    }
+    h.failures[sock]++
+    if !h.down[sock] && h.failures[sock] >= h.ejectAfter {
+        h.down[sock] = true
+        log.Printf("[SHARD_DOWN] %s after %d consecutive dial failures: %v", sock, h.failures[sock], err)
+    }
+}
+
+func (h *shardHealth) ejected() []string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    var out []string
+    for sock := range h.down {
+        out = append(out, sock)
+    }
+    return out
+}
+
+// probe re-dials every ejected shard each interval and restores the ones
+// that answer.
+func (h *shardHealth) probe(interval time.Duration) {
+    for range time.Tick(interval) {
+        for _, sock := range h.ejected() {
+            conn, err := net.DialTimeout("unix", sock, SHARD_PROBE_TIMEOUT)
+            if err != nil {
+                continue
+            }
+            conn.Close()
+            h.mu.Lock()
+            delete(h.down, sock)
+            h.failures[sock] = 0
+            h.mu.Unlock()
+            log.Printf("[SHARD_UP] %s", sock)
+        }
+    }
+}
+
+// ShardPicker chooses the shard for the next request. Pickers skip shards
+// that health has ejected.
+type ShardPicker interface {
+    Pick() (Shard, bool)
+}
+
+type roundRobinPicker struct {
+    shards  []Shard
+    counter uint64
+}
+
+func (p *roundRobinPicker) Pick() (Shard, bool) {
+    active := health.up(p.shards)
+    if len(active) == 0 {
+        return Shard{}, false
+    }
+    idx := atomic.AddUint64(&p.counter, 1) % uint64(len(active))
+    return active[idx], true
+}
+
+// weightedPicker selects shards at random in proportion to their weight.
+type weightedPicker struct {
+    shards []Shard
+}
+
+func newWeightedPicker(all []Shard) *weightedPicker {
+    p := &weightedPicker{}
+    for _, s := range all {
+        if s.Weight > 0 {
+            p.shards = append(p.shards, s)
+        }
+    }
+    return p
+}
+
+func (p *weightedPicker) Pick() (Shard, bool) {
+    active := health.up(p.shards)
+    total := 0
+    for _, s := range active {
+        total += s.Weight
+    }
+    if total == 0 {
+        return Shard{}, false
+    }
+    n := rand.Intn(total)
+    for _, s := range active {
+        if n < s.Weight {
+            return s, true
+        }
+        n -= s.Weight
+    }
+    return active[len(active)-1], true
+}
+
+var picker ShardPicker
+
+// parseShards reads VIGILANT_SHARDS: a comma-separated list of sock[=weight]
+// entries. Weight defaults to 1.
+func parseShards(spec string) ([]Shard, error) {
+    var out []Shard
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        sock, weight, hasWeight := strings.Cut(entry, "=")
+        s := Shard{Sock: sock, Weight: 1}
+        if hasWeight {
+            w, err := strconv.Atoi(weight)
+            if err != nil || w < 0 {
+                return nil, fmt.Errorf("SHARD_INVALID: %q: weight must be a non-negative integer", entry)
+            }
+            s.Weight = w
+        }
+        out = append(out, s)
+    }
+    if len(out) == 0 {
+        return nil, fmt.Errorf("SHARD_INVALID: no shards in %q", spec)
+    }
+    return out, nil
+}
+
+func newPicker(strategy string, all []Shard) (ShardPicker, error) {
+    switch strategy {
+    case "", "round_robin":
+        var active []Shard
+        for _, s := range all {
+            if s.Weight > 0 {
+                active = append(active, s)
+            }
+        }
+        return &roundRobinPicker{shards: active}, nil
+    case "weighted":
+        return newWeightedPicker(all), nil
+    }
+    return nil, fmt.Errorf("SHARD_STRATEGY_INVALID: %q (want round_robin or weighted)", strategy)
+}
+
+// LATENCY_BUCKETS are the histogram bounds in seconds, as in proxy/.
+var LATENCY_BUCKETS = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// pipeMetrics is the pipe's /metrics. Like proxy/, this file vendors no
+// client library: it is built on its own with the stdlib, so the counters
+// and histograms are kept by hand and written in Prometheus text format.
+// A series is keyed by its rendered label set, e.g. `code="200"`.
+type pipeMetrics struct {
+    mu           sync.Mutex
+    requests     map[string]uint64
+    shardErrors  map[string]uint64
+    requestTime  map[string]*histogram
+    shardLatency map[string]*histogram
+}
+
+type histogram struct {
+    counts []uint64
+    sum    float64
+    count  uint64
+}
+
+var metrics = &pipeMetrics{
+    requests:     make(map[string]uint64),
+    shardErrors:  make(map[string]uint64),
+    requestTime:  make(map[string]*histogram),
+    shardLatency: make(map[string]*histogram),
+}
+
+func observe(series map[string]*histogram, labels string, d time.Duration) {
+    h, ok := series[labels]
+    if !ok {
+        h = &histogram{counts: make([]uint64, len(LATENCY_BUCKETS))}
+        series[labels] = h
+    }
+    v := d.Seconds()
+    for i, le := range LATENCY_BUCKETS {
+        if v <= le {
+            h.counts[i]++
+        }
+    }
+    h.sum += v
+    h.count++
+}
+
+// request counts one request to the scan path and its handler latency.
+func (m *pipeMetrics) request(code int, start time.Time) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.requests[fmt.Sprintf("code=%q", strconv.Itoa(code))]++
+    observe(m.requestTime, "", time.Since(start))
+}
+
+// shard records one brain round-trip, dial to last response byte. A
+// round-trip cut short by the client going away isn't the shard's error.
+func (m *pipeMetrics) shard(sock string, start time.Time, ctx context.Context, err error) {
+    labels := fmt.Sprintf("socket=%q", sock)
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    observe(m.shardLatency, labels, time.Since(start))
+    if err != nil && !errors.Is(ctx.Err(), context.Canceled) {
+        m.shardErrors[labels]++
+    }
+}
+
+// withLabels renders name{labels} with extra appended, leaving out the
+// braces when there are no labels at all.
+func withLabels(name, labels, extra string) string {
+    if labels != "" && extra != "" {
+        labels += ","
+    }
+    if labels+extra == "" {
+        return name
+    }
+    return name + "{" + labels + extra + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func writeCounter(w io.Writer, name, help string, series map[string]uint64) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+    for _, labels := range sortedKeys(series) {
+        fmt.Fprintf(w, "%s %d\n", withLabels(name, labels, ""), series[labels])
+    }
+}
+
+func writeHistogram(w io.Writer, name, help string, series map[string]*histogram) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+    for _, labels := range sortedKeys(series) {
+        h := series[labels]
+        for i, le := range LATENCY_BUCKETS {
+            fmt.Fprintf(w, "%s %d\n", withLabels(name+"_bucket", labels, fmt.Sprintf("le=%q", strconv.FormatFloat(le, 'g', -1, 64))), h.counts[i])
+        }
+        fmt.Fprintf(w, "%s %d\n", withLabels(name+"_bucket", labels, `le="+Inf"`), h.count)
+        fmt.Fprintf(w, "%s %g\n", withLabels(name+"_sum", labels, ""), h.sum)
+        fmt.Fprintf(w, "%s %d\n", withLabels(name+"_count", labels, ""), h.count)
+    }
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    metrics.mu.Lock()
+    defer metrics.mu.Unlock()
+    writeCounter(w, "vigilant_pipe_requests_total", "Requests to the scan path, by status code.", metrics.requests)
+    writeCounter(w, "vigilant_pipe_shard_errors_total", "Failed brain round-trips, by shard socket.", metrics.shardErrors)
+    writeHistogram(w, "vigilant_pipe_request_duration_seconds", "Scan handler latency.", metrics.requestTime)
+    writeHistogram(w, "vigilant_pipe_shard_seconds", "Brain round-trip latency from dial to response, by shard socket.", metrics.shardLatency)
+    up := len(health.up(shards))
+    fmt.Fprintf(w, "# HELP vigilant_pipe_shards_up Shards taking traffic.\n# TYPE vigilant_pipe_shards_up gauge\nvigilant_pipe_shards_up %d\n", up)
+}
+
+// statusRecorder captures the status code handle writes.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    if s.status == 0 {
+        s.status = code
+    }
+    s.ResponseWriter.WriteHeader(code)
+}
+
+// withMetrics counts every request to next, rejected ones included.
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w}
+        next(rec, r)
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        metrics.request(rec.status, start)
+    }
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+        return
+    }
     if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    shard, ok := picker.Pick()
+    if !ok {
         http.Error(w, "Security Fabric Offline", 503)
         return
     }
+
+    // The round-trip ends at requestTimeout or when the client goes away,
+    // whichever comes first.
+    ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+    defer cancel()
+
+    start := time.Now()
+    resp, err := roundTrip(ctx, shard.Sock, body)
+    metrics.shard(shard.Sock, start, ctx, err)
+    if err != nil {
+        fabricError(w, ctx)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(resp)
+}
+
+// roundTrip sends body to the brain at sock and reads its whole answer.
+func roundTrip(ctx context.Context, sock string, body []byte) ([]byte, error) {
+    // Dial with a short timeout to prevent hangs
+    dialer := net.Dialer{Timeout: 2 * time.Second}
+    conn, err := dialer.DialContext(ctx, "unix", sock)
+    if ctx.Err() == nil {
+        // A dial cut short by the request says nothing about the shard.
+        health.report(sock, err)
+    }
+    if err != nil {
+        return nil, err
+    }
     defer conn.Close()
+    deadline, _ := ctx.Deadline()
+    conn.SetDeadline(deadline)
+    stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+    defer stop()
 
-    body, _ := io.ReadAll(r.Body)
-    conn.Write(body)
+    if _, err := conn.Write(body); err != nil {
+        return nil, err
+    }
 
     // Signal EOF to the brain
     if cw, ok := conn.(*net.UnixConn); ok {
         cw.CloseWrite()
     }
 
-    resp, _ := io.ReadAll(conn)
+    return io.ReadAll(conn)
+}
+
+// fabricError answers a failed brain round-trip: 504 if it ran out of
+// time, 503 otherwise.
+func fabricError(w http.ResponseWriter, ctx context.Context) {
+    if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+        log.Printf("[BRAIN_TIMEOUT] no answer within %s", requestTimeout)
+        http.Error(w, "Security Fabric Timeout", http.StatusGatewayTimeout)
+        return
+    }
+    http.Error(w, "Security Fabric Offline", 503)
+}
+
+type shardStatus struct {
+    Sock  string `json:"socket"`
+    Error string `json:"error"`
+}
+
+type readyStatus struct {
+    Ready  bool          `json:"ready"`
+    Failed []shardStatus `json:"failed,omitempty"`
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
-    w.Write(resp)
+    w.Write([]byte("{\"status\": \"ok\"}"))
+}
+
+// readyz dials every shard in rotation. Shards back each other up, so the
+// pipe is ready while at least one answers; the rest are listed as failed.
+func readyz(w http.ResponseWriter, r *http.Request) {
+    var failed []shardStatus
+    reachable := 0
+    for _, s := range shards {
+        if s.Weight == 0 {
+            continue
+        }
+        conn, err := net.DialTimeout("unix", s.Sock, SHARD_PROBE_TIMEOUT)
+        if err != nil {
+            failed = append(failed, shardStatus{Sock: s.Sock, Error: err.Error()})
+            continue
+        }
+        conn.Close()
+        reachable++
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if reachable == 0 {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(readyStatus{Ready: reachable > 0, Failed: failed})
 }
 
 func main() {
+    if spec := os.Getenv("VIGILANT_SHARDS"); spec != "" {
+        parsed, err := parseShards(spec)
+        if err != nil {
+            log.Fatal(err)
+        }
+        shards = parsed
+    }
+    if n := os.Getenv("VIGILANT_SHARD_EJECT_AFTER"); n != "" {
+        v, err := strconv.Atoi(n)
+        if err != nil || v < 1 {
+            log.Fatalf("SHARD_INVALID: VIGILANT_SHARD_EJECT_AFTER must be a positive integer, got %q", n)
+        }
+        health = newShardHealth(v)
+    }
+    if n := os.Getenv("VIGILANT_MAX_BODY_BYTES"); n != "" {
+        v, err := strconv.ParseInt(n, 10, 64)
+        if err != nil || v < 1 {
+            log.Fatalf("BODY_LIMIT_INVALID: VIGILANT_MAX_BODY_BYTES must be a positive integer, got %q", n)
+        }
+        maxBodyBytes = v
+    }
+    if t := os.Getenv("VIGILANT_REQUEST_TIMEOUT"); t != "" {
+        d, err := time.ParseDuration(t)
+        if err != nil || d <= 0 {
+            log.Fatalf("REQUEST_TIMEOUT_INVALID: VIGILANT_REQUEST_TIMEOUT must be a duration like 10s, got %q", t)
+        }
+        requestTimeout = d
+    }
+    var err error
+    if picker, err = newPicker(os.Getenv("VIGILANT_SHARD_STRATEGY"), shards); err != nil {
+        log.Fatal(err)
+    }
+
+    go health.probe(SHARD_PROBE_INTERVAL)
+
     log.Println("[GATEWAY] Listening on :8091...")
-    http.HandleFunc("/", handle)
-    log.Fatal(http.ListenAndServe(":8091", nil))
+    grace := DEFAULT_SHUTDOWN_GRACE
+    if g := os.Getenv("VIGILANT_SHUTDOWN_GRACE"); g != "" {
+        d, err := time.ParseDuration(g)
+        if err != nil || d < 0 {
+            log.Fatalf("SHUTDOWN_GRACE_INVALID: VIGILANT_SHUTDOWN_GRACE must be a duration like 15s, got %q", g)
+        }
+        grace = d
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", healthz)
+    mux.HandleFunc("/readyz", readyz)
+    mux.HandleFunc("/metrics", metricsHandler)
+    mux.HandleFunc("/", withMetrics(handle))
+    // Every request context derives from base, so cancelling it aborts the
+    // brain round-trips still in flight.
+    base, abort := context.WithCancel(context.Background())
+    defer abort()
+    server := &http.Server{Addr: ":8091", Handler: mux, BaseContext: func(net.Listener) context.Context { return base }}
+
+    errc := make(chan error, 1)
+    go func() { errc <- server.ListenAndServe() }()
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    select {
+    case err := <-errc:
+        log.Fatal(err)
+    case s := <-sig:
+        log.Printf("[SHUTDOWN] %v: draining for up to %s", s, grace)
+    }
+
+    // Stop accepting, then let in-flight brain round-trips finish. Past the
+    // grace period the rest are cancelled so they answer 503, and whatever
+    // is left after SHUTDOWN_ABORT_WINDOW is closed.
+    ctx, cancel := context.WithTimeout(context.Background(), grace)
+    defer cancel()
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("[SHUTDOWN_TIMEOUT] aborting requests still in flight with 503: %v", err)
+        abort()
+        final, cancelFinal := context.WithTimeout(context.Background(), SHUTDOWN_ABORT_WINDOW)
+        defer cancelFinal()
+        if err := server.Shutdown(final); err != nil {
+            log.Printf("[SHUTDOWN_TIMEOUT] closing connections still open: %v", err)
+            server.Close()
+        }
+    }
+    log.Println("[SHUTDOWN] done")
 }